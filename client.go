@@ -7,6 +7,8 @@ import (
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -14,6 +16,7 @@ var (
 	ErrCannotListen       = errors.New("client cannot listen to music")
 	ErrCannotCastResponse = errors.New("cannot cast API response")
 	ErrNoTracksFound      = errors.New("no tracks found")
+	ErrNoTrackToken       = errors.New("track has no feedback token")
 )
 
 var (
@@ -41,9 +44,16 @@ type Client struct {
 }
 
 func NewClient(credentials Credentials) (*Client, error) {
+	return NewClientWithDescription(gopiano.AndroidClient, credentials, nil)
+}
+
+// NewClientWithDescription allows to log in to another Pandora compatible API, like the one of the pandoratest package.
+// If not nil, httpClient downloads the tracks instead of the client given by the stream.
+func NewClientWithDescription(description gopiano.ClientDescription, credentials Credentials, httpClient *http.Client) (*Client, error) {
 	client := new(Client)
+	client.httpClient = httpClient
 
-	pandora, err := gopiano.NewClient(gopiano.AndroidClient)
+	pandora, err := gopiano.NewClient(description)
 	if err != nil {
 		return nil, err
 	}
@@ -59,9 +69,15 @@ func NewClient(credentials Credentials) (*Client, error) {
 }
 
 func CreateClient() (*Client, error) {
+	return CreateClientWithDescription(gopiano.AndroidClient, nil)
+}
+
+// CreateClientWithDescription is the CreateClient of NewClientWithDescription.
+func CreateClientWithDescription(description gopiano.ClientDescription, httpClient *http.Client) (*Client, error) {
 	client := new(Client)
+	client.httpClient = httpClient
 
-	pandora, err := gopiano.NewClient(gopiano.AndroidClient)
+	pandora, err := gopiano.NewClient(description)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +88,12 @@ func CreateClient() (*Client, error) {
 		Password: uuid.New().String(),
 	}
 
+	// Account creation is authenticated with a partner token, that gopiano only gets by logging in the partner.
+	_, err = pandora.AuthPartnerLogin()
+	if err != nil {
+		return nil, err
+	}
+
 	resp, err := pandora.UserCreateUser(
 		client.cred.Username, client.cred.Password,
 		"Male",
@@ -79,7 +101,6 @@ func CreateClient() (*Client, error) {
 		1980, false,
 	)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -87,6 +108,12 @@ func CreateClient() (*Client, error) {
 		return nil, ErrCannotListen
 	}
 
+	// gopiano does not keep the user token returned with the account, log in to get one.
+	err = client.Auth()
+	if err != nil {
+		return nil, err
+	}
+
 	return client, nil
 }
 
@@ -158,6 +185,17 @@ func (c *Client) GetOrCreateStation(genre string) (string, error) {
 }
 
 func (c *Client) HighQualityTracks(station string, httpClient *http.Client) ([]*Track, error) {
+	return c.playlistTracks(station, httpClient, false)
+}
+
+// AllQualitiesTracks returns the tracks in the highest quality available, with the other qualities as alternate renditions.
+func (c *Client) AllQualitiesTracks(station string, httpClient *http.Client) ([]*Track, error) {
+	return c.playlistTracks(station, httpClient, true)
+}
+
+// playlistTracks returns the tracks of the next playlist of the station, in the highest quality available,
+// and with the other qualities as alternate renditions if alternates is true.
+func (c *Client) playlistTracks(station string, httpClient *http.Client, alternates bool) ([]*Track, error) {
 	it, err := c.doRequest(func() (interface{}, error) {
 		return c.client.StationGetPlaylist(station)
 	})
@@ -169,15 +207,45 @@ func (c *Client) HighQualityTracks(station string, httpClient *http.Client) ([]*
 	if !ok {
 		return nil, ErrCannotCastResponse
 	}
+	httpClient = c.downloadClient(httpClient)
 
 	tracks := make([]*Track, 0, len(resp.Result.Items))
 	for _, item := range resp.Result.Items {
+		info := TrackInfo{item.ArtistName, item.AlbumName, item.SongName, item.AlbumArtURL}
+
+		// Pandora sends ReplayGain values, used to skip loudness measurements.
+		var trackGain *float64
+		if gain, err := strconv.ParseFloat(item.TrackGain, 64); err == nil {
+			trackGain = &gain
+		}
+
+		var track *Track
 		for _, quality := range qualitiesOrder {
-			if audio, exists := item.AudioURLMap[quality]; exists {
-				info := TrackInfo{item.ArtistName, item.AlbumName, item.SongName}
-				tracks = append(tracks, NewTrack(audio.AudioURL, info, httpClient))
+			audio, exists := item.AudioURLMap[quality]
+			if !exists {
+				continue
+			}
+
+			rendition := NewTrack(audio.AudioURL, info, httpClient)
+			rendition.token = item.TrackToken
+			rendition.trackGain = trackGain
+
+			// Tracks without alternates play in the main rendition whatever their quality.
+			if !alternates {
+				track = rendition
 				break
 			}
+
+			rendition.quality = strings.TrimSuffix(quality, "Quality")
+			if track == nil {
+				track = rendition
+			} else {
+				track.alternates = append(track.alternates, rendition)
+			}
+		}
+
+		if track != nil {
+			tracks = append(tracks, track)
 		}
 	}
 
@@ -187,3 +255,28 @@ func (c *Client) HighQualityTracks(station string, httpClient *http.Client) ([]*
 
 	return tracks, nil
 }
+
+// downloadClient returns the HTTP client downloading the tracks, the one of the client if set.
+func (c *Client) downloadClient(httpClient *http.Client) *http.Client {
+	if c.httpClient != nil {
+		return c.httpClient
+	}
+	return httpClient
+}
+
+// NextTracks implements TrackSource using all the qualities available for each track.
+func (c *Client) NextTracks(station string, httpClient *http.Client) ([]*Track, error) {
+	return c.AllQualitiesTracks(station, httpClient)
+}
+
+// Feedback gives a thumb up (positive) or down to a track previously returned by the client.
+func (c *Client) Feedback(station string, track *Track, positive bool) error {
+	if track.token == "" {
+		return ErrNoTrackToken
+	}
+
+	_, err := c.doRequest(func() (interface{}, error) {
+		return c.client.StationAddFeedback(station, track.token, positive)
+	})
+	return err
+}
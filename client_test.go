@@ -0,0 +1,185 @@
+package musiko
+
+import (
+	"github.com/cellofellow/gopiano/responses"
+	"github.com/scotow/musiko/pandoratest"
+	"strings"
+	"testing"
+)
+
+const (
+	testUser     = "user@example.com"
+	testPassword = "password"
+)
+
+func newTestClient(t *testing.T) (*pandoratest.Server, *Client) {
+	t.Helper()
+
+	server := pandoratest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddUser(testUser, testPassword)
+
+	client, err := NewClientWithDescription(server.Description(), Credentials{Username: testUser, Password: testPassword}, server.Client())
+	if err != nil {
+		t.Fatalf("cannot log in: %s", err)
+	}
+
+	return server, client
+}
+
+func TestNewClient(t *testing.T) {
+	t.Parallel()
+	server, _ := newTestClient(t)
+
+	if calls := server.Calls("auth.partnerLogin"); calls != 1 {
+		t.Errorf("auth.partnerLogin called %d times, expected 1", calls)
+	}
+	if calls := server.Calls("auth.userLogin"); calls != 1 {
+		t.Errorf("auth.userLogin called %d times, expected 1", calls)
+	}
+}
+
+func TestNewClientInvalidLogin(t *testing.T) {
+	t.Parallel()
+	server := pandoratest.NewServer()
+	defer server.Close()
+	server.AddUser(testUser, testPassword)
+
+	_, err := NewClientWithDescription(server.Description(), Credentials{Username: testUser, Password: "wrong"}, server.Client())
+	pErr, is := err.(responses.ErrorResponse)
+	if !is || pErr.Code != pandoratest.CodeInvalidLogin {
+		t.Fatalf("expected an invalid login error, got %v", err)
+	}
+}
+
+func TestCreateClient(t *testing.T) {
+	t.Parallel()
+	server := pandoratest.NewServer()
+	defer server.Close()
+
+	client, err := CreateClientWithDescription(server.Description(), server.Client())
+	if err != nil {
+		t.Fatalf("cannot create account: %s", err)
+	}
+	if calls := server.Calls("user.createUser"); calls != 1 {
+		t.Errorf("user.createUser called %d times, expected 1", calls)
+	}
+
+	// The new account can be used right away.
+	_, err = client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station with the new account: %s", err)
+	}
+	if calls := server.Calls("auth.userLogin"); calls != 1 {
+		t.Errorf("auth.userLogin called %d times, expected 1", calls)
+	}
+}
+
+func TestAllQualitiesTracks(t *testing.T) {
+	t.Parallel()
+	server, client := newTestClient(t)
+
+	station, err := client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station: %s", err)
+	}
+
+	tracks, err := client.AllQualitiesTracks(station, nil)
+	if err != nil {
+		t.Fatalf("cannot get playlist: %s", err)
+	}
+	if len(tracks) != server.PlaylistSize {
+		t.Fatalf("got %d tracks, expected %d", len(tracks), server.PlaylistSize)
+	}
+
+	for _, track := range tracks {
+		item, exists := server.Item(track.token)
+		if !exists {
+			t.Fatalf("track token %q not served", track.token)
+		}
+		if track.info.Artist != item.Artist || track.info.Name != item.Song {
+			t.Errorf("got info %+v, expected %+v", track.info, item)
+		}
+		if track.quality != "high" || len(track.alternates) != 2 {
+			t.Errorf("got %s with %d alternates, expected high with 2", track.quality, len(track.alternates))
+		}
+		if track.httpClient == nil {
+			t.Errorf("track has no http client")
+		}
+	}
+}
+
+func TestDoRequestReauth(t *testing.T) {
+	t.Parallel()
+	server, client := newTestClient(t)
+
+	station, err := client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station: %s", err)
+	}
+
+	server.ExpireTokens()
+	_, err = client.AllQualitiesTracks(station, nil)
+	if err != nil {
+		t.Fatalf("request not retried after expiration: %s", err)
+	}
+
+	if calls := server.Calls("auth.partnerLogin"); calls != 2 {
+		t.Errorf("auth.partnerLogin called %d times, expected 2", calls)
+	}
+	if calls := server.Calls("station.getPlaylist"); calls != 2 {
+		t.Errorf("station.getPlaylist called %d times, expected 2", calls)
+	}
+}
+
+func TestDoRequestError(t *testing.T) {
+	t.Parallel()
+	server, client := newTestClient(t)
+
+	_, err := client.AllQualitiesTracks("unknown", nil)
+	pErr, is := err.(responses.ErrorResponse)
+	if !is || pErr.Code != pandoratest.CodeStationNotFound {
+		t.Fatalf("expected a station not found error, got %v", err)
+	}
+	if calls := server.Calls("auth.partnerLogin"); calls != 1 {
+		t.Errorf("re-authenticated on a non auth error")
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	t.Parallel()
+	server, client := newTestClient(t)
+
+	station, _ := client.GetOrCreateStation("G18")
+	tracks, err := client.AllQualitiesTracks(station, nil)
+	if err != nil {
+		t.Fatalf("cannot get playlist: %s", err)
+	}
+
+	err = client.Feedback(station, tracks[1], false)
+	if err != nil {
+		t.Fatalf("cannot send feedback: %s", err)
+	}
+
+	feedbacks := server.Feedbacks()
+	if len(feedbacks) != 1 || feedbacks[0] != (pandoratest.Feedback{Station: station, Track: tracks[1].token, Positive: false}) {
+		t.Fatalf("got feedbacks %+v", feedbacks)
+	}
+}
+
+func TestHighQualityTracks(t *testing.T) {
+	t.Parallel()
+	_, client := newTestClient(t)
+
+	station, _ := client.GetOrCreateStation("G18")
+	tracks, err := client.HighQualityTracks(station, nil)
+	if err != nil {
+		t.Fatalf("cannot get playlist: %s", err)
+	}
+
+	for _, track := range tracks {
+		if track.quality != "" || len(track.alternates) != 0 || !strings.Contains(track.url, "high") {
+			t.Errorf("got %s track %s with %d alternates, expected the high quality only", track.quality, track.url, len(track.alternates))
+		}
+	}
+}
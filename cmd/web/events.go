@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scotow/musiko"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"time"
+)
+
+const (
+	listenersBuffer = 16
+	keepAlive       = 30 * time.Second
+)
+
+// Station event types, on top of the ones of the stream.
+const (
+	nowPlayingEvent = "now_playing"
+	restartingEvent = "restarting"
+)
+
+// stationEvent is a change of a station pushed to the listeners, whatever the stream playing.
+type stationEvent struct {
+	Type       string             `json:"type"`
+	Time       time.Time          `json:"time"`
+	TrackId    string             `json:"trackId,omitempty"`
+	Track      *musiko.TrackInfo  `json:"track,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	NowPlaying *musiko.NowPlaying `json:"nowPlaying,omitempty"`
+}
+
+// forward pushes the track changes, pauses and errors of a stream to the listeners of the radio, until the stream is over.
+func (r *radio) forward(stream *musiko.Stream, events <-chan musiko.Event) {
+	for event := range events {
+		switch event.Type {
+		case musiko.TrackStarted, musiko.TrackFinished, musiko.Paused, musiko.Resumed, musiko.FetchFailed, musiko.Killed:
+		default:
+			continue
+		}
+
+		e := stationEvent{
+			Type:    event.Type.String(),
+			Time:    event.Time,
+			TrackId: event.TrackId,
+			Track:   event.Track,
+		}
+		if event.Err != nil {
+			e.Error = event.Err.Error()
+		}
+		if event.Type == musiko.TrackStarted {
+			e.NowPlaying, _ = stream.NowPlaying()
+		}
+
+		r.broadcast(e)
+	}
+}
+
+func (r *radio) listen() chan stationEvent {
+	events := make(chan stationEvent, listenersBuffer)
+
+	r.Lock()
+	r.listeners[events] = struct{}{}
+	r.Unlock()
+
+	return events
+}
+
+func (r *radio) unlisten(events chan stationEvent) {
+	r.Lock()
+	delete(r.listeners, events)
+	r.Unlock()
+}
+
+// broadcast sends an event to the listeners, dropping it for the ones too slow to keep up.
+func (r *radio) broadcast(event stationEvent) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for listener := range r.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
+
+// nowPlaying returns the event sent to new listeners, nil if nothing is playing.
+func (r *radio) nowPlaying() *stationEvent {
+	stream := r.current()
+	if stream == nil {
+		return nil
+	}
+
+	playing, err := stream.NowPlaying()
+	if err != nil {
+		return nil
+	}
+
+	return &stationEvent{Type: nowPlayingEvent, Time: time.Now(), NowPlaying: playing}
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	radio, ok := radioFromRequest(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := radio.listen()
+	defer radio.unlisten(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// Send the headers before the first event.
+	flusher.Flush()
+
+	write := func(event stationEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+		return err
+	}
+
+	if playing := radio.nowPlaying(); playing != nil {
+		if write(*playing) != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if write(event) != nil {
+				return
+			}
+		case <-ticker.C:
+			// Keep proxies from closing idle connections.
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func eventsSocketHandler(w http.ResponseWriter, r *http.Request) {
+	radio, ok := radioFromRequest(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Accept any origin, like the other read-only endpoints.
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		events := radio.listen()
+		defer radio.unlisten(events)
+
+		// Messages from the client are ignored, reading only detects the closing of the connection.
+		closed := make(chan struct{})
+		go func() {
+			var message string
+			for websocket.Message.Receive(conn, &message) == nil {
+			}
+			close(closed)
+		}()
+
+		if playing := radio.nowPlaying(); playing != nil {
+			if websocket.JSON.Send(conn, playing) != nil {
+				return
+			}
+		}
+
+		for {
+			select {
+			case event := <-events:
+				if websocket.JSON.Send(conn, event) != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(w, r)
+}
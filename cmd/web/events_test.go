@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/scotow/musiko"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRadio registers a radio that never started, and serves its events.
+func newTestRadio(t *testing.T, name string) (*radio, *httptest.Server) {
+	t.Helper()
+
+	radio := newRadio(name, nil, nil)
+	lock.Lock()
+	radios[name] = radio
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		delete(radios, name)
+		lock.Unlock()
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/stations/{name}/events", eventsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/stations/{name}/events/ws", eventsSocketHandler).Methods(http.MethodGet)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return radio, server
+}
+
+// waitListeners waits for the radio to have count listeners.
+func waitListeners(t *testing.T, radio *radio, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		radio.RLock()
+		listeners := len(radio.listeners)
+		radio.RUnlock()
+
+		if listeners == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d listeners, expected %d", listeners, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcastSlowListener(t *testing.T) {
+	radio := newRadio("test", nil, nil)
+	events := radio.listen()
+
+	// Nothing is read while the radio broadcasts, the extra events are dropped without blocking.
+	for i := 0; i < 2*listenersBuffer; i++ {
+		radio.broadcast(stationEvent{Type: restartingEvent})
+	}
+	if len(events) != listenersBuffer {
+		t.Errorf("got %d events queued, expected %d", len(events), listenersBuffer)
+	}
+
+	radio.unlisten(events)
+	for len(events) > 0 {
+		<-events
+	}
+	radio.broadcast(stationEvent{Type: restartingEvent})
+	if len(events) != 0 {
+		t.Errorf("event received after unlistening")
+	}
+}
+
+func TestForward(t *testing.T) {
+	stream, err := musiko.NewStream(nil, "", musiko.StreamOptions{})
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	radio := newRadio("test", nil, nil)
+	listener := radio.listen()
+
+	events := make(chan musiko.Event, 4)
+	events <- musiko.Event{Type: musiko.TrackStarted, TrackId: "track", Track: &musiko.TrackInfo{Name: "Song"}}
+	events <- musiko.Event{Type: musiko.SegmentPublished, TrackId: "track"}
+	events <- musiko.Event{Type: musiko.Paused}
+	events <- musiko.Event{Type: musiko.FetchFailed, Err: errors.New("no tracks")}
+	close(events)
+
+	// Only the changes of the station are forwarded.
+	radio.forward(stream, events)
+	if len(listener) != 3 {
+		t.Fatalf("got %d events, expected 3", len(listener))
+	}
+	if event := <-listener; event.Type != "track_started" || event.TrackId != "track" || event.Track.Name != "Song" {
+		t.Errorf("got event %+v, expected the started track", event)
+	}
+	if event := <-listener; event.Type != "paused" {
+		t.Errorf("got event %+v, expected paused", event)
+	}
+	if event := <-listener; event.Type != "fetch_failed" || event.Error != "no tracks" {
+		t.Errorf("got event %+v, expected the fetch error", event)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	radio, server := newTestRadio(t, "sse")
+
+	resp, err := http.Get(server.URL + "/stations/sse/events")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %s %s, expected an event stream", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	waitListeners(t, radio, 1)
+	radio.broadcast(stationEvent{Type: restartingEvent, Time: time.Now(), Error: "stream stopped"})
+
+	// Each event is sent with its type, followed by its JSON.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "event: restarting\n" {
+		t.Fatalf("got line %q, expected the restarting event", line)
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("got line %q, expected its data", line)
+	}
+	var event stationEvent
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+	if err != nil || event.Type != restartingEvent || event.Error != "stream stopped" {
+		t.Errorf("got data %q, expected the restarting event", line)
+	}
+
+	// The listener is removed with the connection.
+	_ = resp.Body.Close()
+	waitListeners(t, radio, 0)
+
+	resp, err = http.Get(server.URL + "/stations/unknown/events")
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v for an unknown station, expected 404", err)
+	}
+}
+
+func TestEventsSocketHandler(t *testing.T) {
+	radio, server := newTestRadio(t, "ws")
+
+	conn, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/stations/ws/events/ws", "", server.URL)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+
+	waitListeners(t, radio, 1)
+	radio.broadcast(stationEvent{Type: restartingEvent, Time: time.Now(), Error: "stream stopped"})
+
+	var event stationEvent
+	_ = conn.SetReadDeadline(time.Now().Add(testTimeout))
+	err = websocket.JSON.Receive(conn, &event)
+	if err != nil || event.Type != restartingEvent || event.Error != "stream stopped" {
+		t.Errorf("got event %+v (%v), expected the restarting event", event, err)
+	}
+
+	// The listener is removed with the connection.
+	_ = conn.Close()
+	waitListeners(t, radio, 0)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/scotow/musiko"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	icyMetaInt     = 16000 // Audio bytes between two metadata blocks.
+	icyMaxBlocks   = 255
+	restartPolling = time.Second
+)
+
+var (
+	errFormatChanged = errors.New("audio format changed")
+)
+
+// icyWriter interleaves ICY metadata blocks in an audio stream. The title is only sent when it changes.
+type icyWriter struct {
+	writer    io.Writer
+	remaining int
+	title     string
+	pending   bool
+}
+
+func newIcyWriter(writer io.Writer) *icyWriter {
+	w := new(icyWriter)
+	w.writer = writer
+	w.remaining = icyMetaInt
+
+	return w
+}
+
+// SetTitle sends a new title with the next metadata block.
+func (w *icyWriter) SetTitle(title string) {
+	w.title = title
+	w.pending = true
+}
+
+func (w *icyWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > w.remaining {
+			n = w.remaining
+		}
+
+		m, err := w.writer.Write(data[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+		w.remaining -= n
+
+		if w.remaining == 0 {
+			_, err = w.writer.Write(w.metadata())
+			if err != nil {
+				return written, err
+			}
+			w.remaining = icyMetaInt
+		}
+	}
+
+	return written, nil
+}
+
+// metadata returns the next metadata block, a single zero byte if the title did not change.
+func (w *icyWriter) metadata() []byte {
+	if !w.pending {
+		return []byte{0}
+	}
+	w.pending = false
+
+	text := fmt.Sprintf("StreamTitle='%s';", w.title)
+	if len(text) > icyMaxBlocks*16 {
+		text = text[:icyMaxBlocks*16-2] + "';"
+	}
+
+	blocks := (len(text) + 15) / 16
+	block := make([]byte, 1+blocks*16)
+	block[0] = byte(blocks)
+	copy(block[1:], text)
+
+	return block
+}
+
+// streamTitle returns the title of a track in the ICY metadata.
+func streamTitle(info musiko.TrackInfo) string {
+	title := info.Name
+	if info.Artist != "" {
+		title = info.Artist + " - " + info.Name
+	}
+
+	// Quotes end the title for most clients.
+	return strings.NewReplacer("'", "’", "\r", " ", "\n", " ").Replace(title)
+}
+
+// audioStreamHandler serves the played audio of a station as a continuous stream, following the restarts of the station.
+func audioStreamHandler(w http.ResponseWriter, r *http.Request) {
+	radio, stream, ok := streamFromRequest(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		writer      io.Writer = w
+		icy         *icyWriter
+		started     bool
+		contentType string
+		trackId     string
+	)
+	if r.Header.Get("Icy-MetaData") == "1" {
+		icy = newIcyWriter(w)
+		writer = icy
+	}
+
+	listener := func(part musiko.AudioPart) error {
+		if !started {
+			w.Header().Set("Content-Type", part.ContentType)
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("icy-name", radio.name)
+			if icy != nil {
+				w.Header().Set("icy-metaint", fmt.Sprint(icyMetaInt))
+			}
+			w.WriteHeader(http.StatusOK)
+			started = true
+			contentType = part.ContentType
+		}
+
+		// The format of the response cannot change, the client reconnects to get the new one.
+		if part.ContentType != contentType {
+			log.Printf("Audio format of station %s changed to %s, closing the audio stream.\n", radio.name, part.ContentType)
+			return errFormatChanged
+		}
+
+		if icy != nil && part.TrackId != trackId {
+			icy.SetTitle(streamTitle(part.Track))
+		}
+		trackId = part.TrackId
+
+		_, err := writer.Write(part.Data)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		// Listeners keep the station from pausing.
+		radio.reset()
+		return nil
+	}
+
+	for {
+		// Resume the station if it was paused.
+		radio.reset()
+
+		err := stream.ListenAudio(r.Context(), listener)
+		if err != musiko.ErrStreamStopped {
+			// Once started, errors mean the listener left.
+			if !started && err != r.Context().Err() {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Wait for the restart of the station.
+		for radio.current() == stream {
+			select {
+			case <-time.After(restartPolling):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		stream = radio.current()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/scotow/musiko"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	errFrameSync = errors.New("no ADTS frame sync")
+)
+
+// readADTSFrames reads the ADTS frames of r until it fails, counting them in frames.
+func readADTSFrames(r io.Reader, frames *int64) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 7)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return err
+		}
+		length := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+		if header[0] != 0xFF || header[1]&0xF0 != 0xF0 || length < len(header) {
+			return errFrameSync
+		}
+		_, err = io.CopyN(ioutil.Discard, reader, int64(length-len(header)))
+		if err != nil {
+			return err
+		}
+
+		atomic.AddInt64(frames, 1)
+	}
+}
+
+func TestAudioStreamHandler(t *testing.T) {
+	// Each track is a single part.
+	server, client, station := newTestStation(t)
+	server.TrackDuration = 3 * time.Second
+
+	radio := newRadio("audio", func() (*musiko.Stream, error) {
+		return musiko.NewStream(client, station, musiko.StreamOptions{SegmentTime: 4 * time.Second})
+	}, nil)
+	lock.Lock()
+	radios["audio"] = radio
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		delete(radios, "audio")
+		lock.Unlock()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	done := runSupervisor(ctx, radio, started)
+	defer waitStopped(t, done)
+	defer cancel()
+	<-started
+
+	router := mux.NewRouter()
+	router.HandleFunc("/stations/{name}/stream", audioStreamHandler).Methods(http.MethodGet)
+	listener := httptest.NewServer(router)
+	defer listener.Close()
+
+	resp, err := http.Get(listener.URL + "/stations/audio/stream")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "audio/aac" {
+		t.Fatalf("got %s %s, expected an AAC stream", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	var frames int64
+	result := make(chan error, 1)
+	go func() {
+		result <- readADTSFrames(resp.Body, &frames)
+	}()
+
+	// The frames of the next track follow the ones of the first track, without a broken frame in between.
+	trackFrames := int64(server.TrackDuration.Seconds() * 44100 / 1024)
+	deadline := time.Now().Add(testTimeout)
+	for atomic.LoadInt64(&frames) < trackFrames+trackFrames/2 {
+		select {
+		case err := <-result:
+			t.Fatalf("audio stream broken after %d frames: %v", atomic.LoadInt64(&frames), err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d frames, expected the ones of two tracks", atomic.LoadInt64(&frames))
+		}
+	}
+}
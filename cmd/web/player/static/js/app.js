@@ -6,6 +6,8 @@ const trackName = document.getElementById('track-name');
 const trackArtist = document.getElementById('track-artist');
 const trackAlbum = document.getElementById('track-album');
 const download = document.getElementById('download');
+const thumbUp = document.getElementById('thumb-up');
+const thumbDown = document.getElementById('thumb-down');
 
 const pause = 'M11,10 L18,13.74 18,22.28 11,26 M18,13.74 L26,18 26,18 18,22.28';
 const play = 'M11,10 L17,10 17,26 11,26 M20,10 L26,10 26,26 20,26';
@@ -36,6 +38,8 @@ function stationsLoaded(info) {
         slider.oninput = volumeSliderChanged;
 
         download.onclick = downloadTrack;
+        thumbUp.onclick = sendFeedback.bind(null, true);
+        thumbDown.onclick = sendFeedback.bind(null, false);
 
         document.getElementById('play-pause').onclick = togglePlayPause;
         document.getElementById('volume-down').onclick = volumeDown;
@@ -64,7 +68,7 @@ function startingStation(info) {
 }
 
 function playlistAddress(station) {
-    return `/stations/${station}/playlist.m3u8`;
+    return `/stations/${station}/master.m3u8`;
 }
 
 function displayStations(stations) {
@@ -132,6 +136,7 @@ function fragmentChanged(event, data) {
     if (track === currentTrack) return;
 
     currentTrack = track;
+    resetFeedback();
     fetchJson(`/${track}/info`)
         .then(info => {
             trackName.innerText = info.name;
@@ -150,6 +155,28 @@ function downloadTrack() {
     window.location = `/${currentTrack}/download`
 }
 
+function sendFeedback(positive) {
+    if (!currentTrack) return;
+
+    const track = currentTrack;
+    fetch(`/${track}/feedback`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ positive: positive })
+    }).then(resp => {
+        if (!resp.ok || track !== currentTrack) return;
+
+        thumbUp.classList.toggle('selected', positive);
+        thumbDown.classList.toggle('selected', !positive);
+    });
+}
+
+function resetFeedback() {
+    for (let button of [thumbUp, thumbDown]) {
+        button.classList.remove('selected', 'disabled');
+    }
+}
+
 function togglePlayPause() {
     audio.paused ? audio.play() : audio.pause();
 }
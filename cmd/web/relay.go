@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"github.com/scotow/musiko"
+	"github.com/scotow/musiko/icecast"
+	"log"
+	"time"
+)
+
+const (
+	relayRetry = 5 * time.Second
+)
+
+// relay pushes the audio of the radio to an Icecast mount, reconnecting after failures and restarts of the radio.
+func (r *radio) relay(source *icecast.Source) {
+	for {
+		if stream := r.current(); stream != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			go r.keepPlaying(ctx)
+
+			err := source.Run(ctx, stream)
+			cancel()
+			if err != musiko.ErrStreamStopped {
+				log.Printf("Icecast relay of station %s failed: %s.\n", r.name, err.Error())
+			}
+		}
+
+		time.Sleep(relayRetry)
+	}
+}
+
+// keepPlaying prevents the automatic pause of the radio until ctx is cancelled, resuming it if needed.
+func (r *radio) keepPlaying(ctx context.Context) {
+	ticker := time.NewTicker(pauseTick)
+	defer ticker.Stop()
+
+	for {
+		r.reset()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
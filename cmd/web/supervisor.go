@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/scotow/musiko"
+	"github.com/scotow/musiko/timeout"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+	stableTime = 10 * time.Minute // Running time after which a stream is healthy again, resetting the backoff.
+)
+
+// Radio states, the state of the stream is used while it plays.
+const (
+	starting   = "starting"
+	restarting = "restarting"
+)
+
+type radio struct {
+	name   string
+	stream *musiko.Stream
+	pause  *timeout.AutoPauser
+
+	history *musiko.History
+
+	create func() (*musiko.Stream, error)
+	auth   func() error // Re-authenticates the source before a restart, nil if not needed.
+	wait   func(ctx context.Context, delay time.Duration) bool
+
+	state     string
+	retries   int // Consecutive failures.
+	restarts  int
+	lastError error
+	retryAt   time.Time
+
+	listeners map[chan stationEvent]struct{}
+	sync.RWMutex
+}
+
+type radioStatus struct {
+	State     string     `json:"state"`
+	Retries   int        `json:"retries"`
+	Restarts  int        `json:"restarts"`
+	LastError string     `json:"lastError,omitempty"`
+	RetryAt   *time.Time `json:"retryAt,omitempty"`
+}
+
+func newRadio(name string, create func() (*musiko.Stream, error), auth func() error) *radio {
+	r := new(radio)
+	r.name = name
+	r.create = create
+	r.auth = auth
+	r.wait = sleep
+	r.state = starting
+	r.listeners = make(map[chan stationEvent]struct{})
+
+	return r
+}
+
+// supervise plays the stream of the radio, and restarts it with an exponential backoff each time it fails.
+// New streams continue the playlists of the previous ones. started is closed after the first attempt.
+// The playing stream is stopped once ctx is done.
+func (r *radio) supervise(ctx context.Context, started chan<- struct{}) {
+	var previous *musiko.Stream
+
+	for {
+		stream, err := r.start(previous)
+		if started != nil {
+			close(started)
+			started = nil
+		}
+		if stream != nil {
+			previous = stream
+		}
+
+		if err == nil {
+			since := time.Now()
+			select {
+			case <-stream.Done():
+				err = stream.Err()
+			case <-ctx.Done():
+				_ = stream.Stop()
+			}
+
+			r.Lock()
+			r.pause.Stop()
+			if time.Since(since) >= stableTime {
+				r.retries = 0
+			}
+			r.Unlock()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := r.failed(err)
+		r.broadcast(stationEvent{Type: restartingEvent, Time: time.Now(), Error: err.Error()})
+		if !r.wait(ctx, delay) {
+			return
+		}
+
+		if r.auth != nil {
+			err = r.auth()
+			if err != nil {
+				log.Printf("Cannot re-authenticate station %s: %s.\n", r.name, err.Error())
+			}
+		}
+	}
+}
+
+// start creates and starts a new stream, returning it even if it failed to start.
+func (r *radio) start(previous *musiko.Stream) (*musiko.Stream, error) {
+	stream, err := r.create()
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("stream creation error: ", err.Error()))
+	}
+
+	if previous != nil {
+		err = stream.Continue(previous)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("stream continuation error: ", err.Error()))
+		}
+	}
+
+	// Subscribe before starting to get the first track.
+	go r.forward(stream, stream.Subscribe())
+
+	err = stream.Start(context.Background())
+	if err != nil {
+		return stream, errors.New(fmt.Sprint("start stream error: ", err.Error()))
+	}
+
+	pause := timeout.NewAutoPauser(stream, pauseTimeout, pauseTick)
+	go func() {
+		err := pause.Start()
+		if err != nil {
+			log.Printf("Auto pause error on station %s: %s.\n", r.name, err.Error())
+		}
+	}()
+
+	r.Lock()
+	r.stream = stream
+	r.pause = pause
+	r.state = ""
+	r.Unlock()
+
+	return stream, nil
+}
+
+// failed records the error ending the stream, and returns the delay before the next attempt.
+func (r *radio) failed(err error) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	delay := minBackoff
+	for i := 0; i < r.retries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	r.state = restarting
+	r.retries++
+	r.restarts++
+	r.lastError = err
+	r.retryAt = time.Now().Add(delay)
+
+	log.Printf("Station %s failed: %s. Restarting in %s.\n", r.name, err.Error(), delay)
+	return delay
+}
+
+// sleep waits for delay, returns false if ctx is done first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// current returns the playing stream, or the last one while restarting, nil if it never started.
+func (r *radio) current() *musiko.Stream {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.stream
+}
+
+// reset delays the automatic pause of the stream.
+func (r *radio) reset() {
+	r.RLock()
+	pause := r.pause
+	r.RUnlock()
+
+	if pause != nil {
+		pause.Reset()
+	}
+}
+
+func (r *radio) status() radioStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	status := radioStatus{
+		State:    r.state,
+		Retries:  r.retries,
+		Restarts: r.restarts,
+	}
+	if r.state == "" {
+		status.State = r.stream.State()
+	}
+	if r.lastError != nil {
+		status.LastError = r.lastError.Error()
+	}
+	if r.state == restarting {
+		retryAt := r.retryAt
+		status.RetryAt = &retryAt
+	}
+
+	return status
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/scotow/musiko"
+	"github.com/scotow/musiko/pandoratest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeout = 10 * time.Second
+
+// runSupervisor supervises the radio in the background, the returned channel is closed once the supervisor returns.
+func runSupervisor(ctx context.Context, radio *radio, started chan<- struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		radio.supervise(ctx, started)
+	}()
+
+	return done
+}
+
+// waitStopped waits for the supervisor to return.
+func waitStopped(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("supervisor not stopped")
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	var calls []string
+	radio := newRadio("test", func() (*musiko.Stream, error) {
+		calls = append(calls, "create")
+		return nil, errors.New("source unavailable")
+	}, func() error {
+		calls = append(calls, "auth")
+		return nil
+	})
+
+	expected := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		64 * time.Second, 128 * time.Second, 256 * time.Second, maxBackoff, maxBackoff, maxBackoff,
+	}
+
+	// The last wait is interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var delays []time.Duration
+	radio.wait = func(ctx context.Context, delay time.Duration) bool {
+		calls = append(calls, "wait")
+		delays = append(delays, delay)
+		if len(delays) == len(expected) {
+			cancel()
+		}
+		return ctx.Err() == nil
+	}
+
+	waitStopped(t, runSupervisor(ctx, radio, nil))
+
+	if len(delays) != len(expected) {
+		t.Fatalf("got delays %v, expected %v", delays, expected)
+	}
+	for i, delay := range delays {
+		if delay != expected[i] {
+			t.Errorf("got delays %v, expected %v", delays, expected)
+			break
+		}
+	}
+
+	// The source is re-authenticated before each restart.
+	for i, call := range calls {
+		if expected := []string{"create", "wait", "auth"}[i%3]; call != expected {
+			t.Fatalf("got calls %v, expected create, wait and auth in turn", calls)
+		}
+	}
+	if len(calls) != 3*len(expected)-1 {
+		t.Errorf("got %d calls, expected %d", len(calls), 3*len(expected)-1)
+	}
+
+	status := radio.status()
+	if status.State != restarting || status.Retries != len(expected) || !strings.Contains(status.LastError, "source unavailable") {
+		t.Errorf("got status %+v after %d failures", status, len(expected))
+	}
+}
+
+// newTestStation creates a station of the fake Pandora API.
+func newTestStation(t *testing.T) (*pandoratest.Server, *musiko.Client, string) {
+	t.Helper()
+
+	server := pandoratest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddUser("user@example.com", "password")
+
+	client, err := musiko.NewClientWithDescription(server.Description(), musiko.Credentials{Username: "user@example.com", Password: "password"}, server.Client())
+	if err != nil {
+		t.Fatalf("cannot log in: %s", err)
+	}
+	station, err := client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station: %s", err)
+	}
+
+	return server, client, station
+}
+
+func TestSupervisorStop(t *testing.T) {
+	_, client, station := newTestStation(t)
+
+	radio := newRadio("test", func() (*musiko.Stream, error) {
+		return musiko.NewStream(client, station, musiko.StreamOptions{SegmentTime: 2 * time.Second})
+	}, nil)
+	radio.wait = func(context.Context, time.Duration) bool {
+		t.Errorf("stream restarted")
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	done := runSupervisor(ctx, radio, started)
+	<-started
+
+	stream := radio.current()
+	if stream == nil {
+		t.Fatalf("stream not started: %+v", radio.status())
+	}
+
+	// The playing stream is stopped with the supervisor.
+	cancel()
+	waitStopped(t, done)
+	select {
+	case <-stream.Done():
+	default:
+		t.Errorf("stream still playing")
+	}
+}
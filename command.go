@@ -1,15 +1,33 @@
 package musiko
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrLoudnessNotFound = errors.New("ffmpeg did not report the integrated loudness")
+)
+
+var (
+	integratedLoudness = regexp.MustCompile(`I:\s+(-?[0-9.]+) LUFS`)
 )
 
 var (
 	ffmpegCommand = "ffmpeg"
+	ffmpegCopy    = []string{"-c", "copy"}
+	ffmpegAAC     = []string{"-c:a", "aac", "-b:a", "256k"}
 )
 
 func commandExists(name string) bool {
@@ -25,23 +43,119 @@ func FfmpegInstalled() bool {
 }
 
 func FfmpegSplitTS(reader io.Reader, dest string) (string, error) {
+	return FfmpegTranscodeTS(context.Background(), reader, dest, ffmpegCopy, defaultSegmentTime)
+}
+
+// FfmpegTranscodeTS is FfmpegSplitTS using the given ffmpeg codec arguments and segment time.
+func FfmpegTranscodeTS(ctx context.Context, reader io.Reader, dest string, codec []string, segmentTime time.Duration) (string, error) {
+	return ffmpegSplit(ctx, "-", reader, dest, codec, segmentTime)
+}
+
+// FfmpegSplitFileTS reads the input from a seekable file, which is required for some containers (e.g. m4a with a trailing moov atom).
+func FfmpegSplitFileTS(ctx context.Context, input string, dest string, codec []string, segmentTime time.Duration) (string, error) {
+	return ffmpegSplit(ctx, input, nil, dest, codec, segmentTime)
+}
+
+func ffmpegSplit(ctx context.Context, input string, reader io.Reader, dest string, codec []string, segmentTime time.Duration) (string, error) {
+	playlist, output := ffmpegSegmentOutput(dest, segmentTime)
+
+	args := []string{"-i", input, "-map", "0:a"}
+	args = append(args, codec...)
+	args = append(args, output...)
+
+	cmd := exec.CommandContext(ctx, ffmpegCommand, args...)
+	cmd.Stdin = reader
+
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	return playlist, nil
+}
+
+// ffmpegSegmentOutput returns the path of the playlist listing the parts written in dest, and the output arguments writing them.
+func ffmpegSegmentOutput(dest string, segmentTime time.Duration) (string, []string) {
 	id := uuid.New().String()
 
 	playlist := path.Join(dest, fmt.Sprintf("%s.m3u8", id))
 	ts := path.Join(dest, fmt.Sprintf("%s-%%d.ts", id))
 
-	cmd := exec.Command(ffmpegCommand,
-		"-i", "-",
-		"-c", "copy",
+	return playlist, []string{
 		"-f", "segment",
 		"-segment_list", playlist,
-		"-segment_time", "10",
+		"-segment_time", strconv.FormatFloat(segmentTime.Seconds(), 'f', -1, 64),
 		"-segment_list_flags", "+live",
-		ts)
+		ts,
+	}
+}
+
+// FfmpegEncodeMP4 encodes the input in an MP4 file starting with its moov atom, so it can be demuxed progressively.
+// If reader is not nil, input should be "-".
+func FfmpegEncodeMP4(ctx context.Context, input string, reader io.Reader, codec []string) ([]byte, error) {
+	tmp, err := ioutil.TempDir("", "musiko")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
 
+	output := path.Join(tmp, "track.m4a")
+
+	args := []string{"-i", input, "-map", "0:a"}
+	args = append(args, codec...)
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", output)
+
+	cmd := exec.CommandContext(ctx, ffmpegCommand, args...)
 	cmd.Stdin = reader
 
+	err = cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(output)
+}
+
+// FfmpegLoudness measures the EBU R128 integrated loudness of the input, in LUFS. If reader is not nil, input should be "-".
+func FfmpegLoudness(ctx context.Context, input string, reader io.Reader) (float64, error) {
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.CommandContext(ctx, ffmpegCommand, "-nostats", "-i", input, "-map", "0:a", "-af", "ebur128", "-f", "null", "-")
+	cmd.Stdin = reader
+	cmd.Stderr = stderr
+
 	err := cmd.Run()
+	if err != nil {
+		return 0, err
+	}
+
+	// The last value is the one of the summary, the others are the running values.
+	matches := integratedLoudness.FindAllSubmatch(stderr.Bytes(), -1)
+	if len(matches) == 0 {
+		return 0, ErrLoudnessNotFound
+	}
+
+	return strconv.ParseFloat(string(matches[len(matches)-1][1]), 64)
+}
+
+// FfmpegCrossfade mixes the end of tail with the start of head over duration seconds, and splits the result in dest like FfmpegTranscodeTS.
+func FfmpegCrossfade(ctx context.Context, tail []byte, head []byte, duration float64, dest string, codec []string, segmentTime time.Duration) (string, error) {
+	inputs := []string{path.Join(dest, "tail.ts"), path.Join(dest, "head.ts")}
+	for i, data := range [][]byte{tail, head} {
+		err := ioutil.WriteFile(inputs[i], data, 0600)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	playlist, output := ffmpegSegmentOutput(dest, segmentTime)
+
+	args := []string{"-i", inputs[0], "-i", inputs[1],
+		"-filter_complex", fmt.Sprintf("[0:a][1:a]acrossfade=d=%.3f", duration)}
+	args = append(args, codec...)
+	args = append(args, output...)
+
+	err := exec.CommandContext(ctx, ffmpegCommand, args...).Run()
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,91 @@
+package musiko
+
+import (
+	"errors"
+	"github.com/grafov/m3u8"
+)
+
+var (
+	ErrStreamNotOver = errors.New("stream not over")
+)
+
+// sequence is the position reached by a playlist, from which another stream can continue it.
+type sequence struct {
+	media         uint64
+	discontinuity uint64
+}
+
+// Continue makes the playlists of the stream follow the ones of previous, which must be over,
+// so players keep playing after a restart. Must be called before starting the stream.
+func (s *Stream) Continue(previous *Stream) error {
+	select {
+	case <-previous.done:
+	default:
+		return ErrStreamNotOver
+	}
+
+	if s.state != stopped {
+		return ErrStreamAlreadyStarted
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.starts = previous.ends
+	s.continuePlaylist("", s.playlist)
+
+	return nil
+}
+
+// continuePlaylist sets the sequence numbers of a new playlist of the rendition, if the stream continues another one.
+// The first part of the stream always has a discontinuity tag.
+func (s *Stream) continuePlaylist(name string, playlist *m3u8.MediaPlaylist) {
+	start, exists := s.starts[name]
+	if !exists {
+		start, exists = s.starts[""]
+	}
+	if !exists {
+		return
+	}
+
+	playlist.SeqNo = start.media
+	playlist.DiscontinuitySeq = start.discontinuity
+}
+
+// recordEnds saves the sequences following the parts seen by the players, before the tracks are released.
+// Parts queued after the window were never listed, so the next stream takes their place.
+func (s *Stream) recordEnds() {
+	s.ends = make(map[string]sequence)
+
+	if len(s.renditions) == 0 {
+		s.ends[""] = sequence{s.playlist.SeqNo, s.playlist.DiscontinuitySeq}
+		return
+	}
+
+	for r, rendition := range s.renditions {
+		visible := rendition.playlist.Count()
+		if window := rendition.playlist.WinSize(); window < visible {
+			visible = window
+		}
+
+		end := sequence{rendition.playlist.SeqNo + uint64(visible), rendition.playlist.DiscontinuitySeq}
+
+		var seen uint
+		for _, track := range s.queue {
+			for _, part := range track.queue {
+				if seen == visible {
+					break
+				}
+				if part.renditions[r].Discontinuity {
+					end.discontinuity++
+				}
+				seen++
+			}
+		}
+
+		s.ends[rendition.name] = end
+		if r == 0 {
+			s.ends[""] = end
+		}
+	}
+}
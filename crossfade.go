@@ -0,0 +1,68 @@
+package musiko
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// pendingPart is a part waiting to be published.
+type pendingPart struct {
+	track      *Track
+	part       *Part
+	alternates []*Part
+	index      int
+}
+
+// bridgeRenderer mixes the tail part of a track with the head part of the next one over overlap seconds,
+// and returns the mix cut in parts of about segmentTime.
+type bridgeRenderer func(ctx context.Context, tail *Part, head *Part, overlap float64, segmentTime time.Duration, codec []string) ([]*Part, error)
+
+// ffmpegBridge renders the bridge with ffmpeg.
+func ffmpegBridge(ctx context.Context, tail *Part, head *Part, overlap float64, segmentTime time.Duration, codec []string) ([]*Part, error) {
+	tmp, err := ioutil.TempDir("", "musiko")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	playlistPath, err := FfmpegCrossfade(ctx, tail.data, head.data, overlap, tmp, codec, segmentTime)
+	if err != nil {
+		return nil, err
+	}
+
+	_, parts, err := ffmpegPlaylistParts(tmp, playlistPath)
+	return parts, err
+}
+
+// crossfade renders the tail of a track and the head of the next one into bridge parts, replacing the head.
+// The bridge is cut evenly in parts no longer than the target duration of the next track, all but the last one are published.
+// The tail is published as is if the bridge cannot be rendered. Returns the part to publish instead of head, and whether it is a bridge.
+func (s *Stream) crossfade(tail *pendingPart, head *pendingPart, publish func(*pendingPart)) (*pendingPart, bool) {
+	defer s.completeTrack(tail.track)
+
+	overlap := math.Min(s.Crossfade.Seconds(), math.Min(tail.part.seg.Duration, head.part.seg.Duration))
+	duration := tail.part.seg.Duration + head.part.seg.Duration - overlap
+	count := math.Ceil(duration / head.track.targetDuration().Seconds())
+	segmentTime := time.Duration(duration / count * float64(time.Second))
+
+	parts, err := s.renderBridge(s.ctx, tail.part, head.part, overlap, segmentTime, s.options.Profile.ffmpegArgs(0))
+	if err == nil && len(parts) == 0 {
+		err = ErrSplitMismatch
+	}
+	if err != nil {
+		log.Printf("Cannot crossfade tracks: %s (%s).\n", err.Error(), head.track.id.String())
+		publish(tail)
+		return head, false
+	}
+
+	// Alternate renditions use the bridge too.
+	last := len(parts) - 1
+	for i, part := range parts[:last] {
+		publish(&pendingPart{head.track, part, make([]*Part, len(head.alternates)), i})
+	}
+	return &pendingPart{head.track, parts[last], make([]*Part, len(head.alternates)), last}, true
+}
@@ -0,0 +1,142 @@
+package musiko
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"math"
+	"testing"
+	"time"
+)
+
+// testBridge is a bridge rendered by a test renderer.
+type testBridge struct {
+	tail    *Part
+	head    *Part
+	overlap float64
+	parts   []*Part
+}
+
+// testBridgeRenderer cuts the bridge like ffmpeg without mixing the audio, the parts reuse the data of the head, and sends it to rendered.
+func testBridgeRenderer(rendered chan<- testBridge) bridgeRenderer {
+	return func(_ context.Context, tail *Part, head *Part, overlap float64, segmentTime time.Duration, _ []string) ([]*Part, error) {
+		var parts []*Part
+		for remaining := tail.seg.Duration + head.seg.Duration - overlap; remaining > 1e-6; remaining -= segmentTime.Seconds() {
+			seg := &m3u8.MediaSegment{Duration: math.Min(remaining, segmentTime.Seconds())}
+			parts = append(parts, &Part{data: append([]byte(nil), head.data...), seg: seg})
+		}
+
+		select {
+		case rendered <- testBridge{tail, head, overlap, parts}:
+		default:
+		}
+		return parts, nil
+	}
+}
+
+// checkIndexes checks that the parts of the track are listed with contiguous indexes.
+func checkIndexes(t *testing.T, track *Track) {
+	t.Helper()
+
+	for i, part := range track.parts {
+		if expected := fmt.Sprintf("%s/%d", track.id.String(), i); part.seg.URI != expected {
+			t.Errorf("got part %s, expected %s", part.seg.URI, expected)
+		}
+	}
+}
+
+func TestStreamCrossfade(t *testing.T) {
+	t.Parallel()
+	_, client := newTestClient(t)
+
+	station, err := client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station: %s", err)
+	}
+	options := StreamOptions{SegmentTime: 2 * time.Second}
+	stream, err := NewStream(client, station, options)
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	stream.URIModifier = func(id string, index int) string {
+		return fmt.Sprintf("%s/%d", id, index)
+	}
+	stream.Crossfade = time.Second
+
+	rendered := make(chan testBridge, 1)
+	stream.renderBridge = testBridgeRenderer(rendered)
+
+	err = stream.Start(context.Background())
+	if err != nil {
+		t.Fatalf("cannot start stream: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = stream.Stop()
+	})
+
+	var bridge testBridge
+	select {
+	case bridge = <-rendered:
+	case <-time.After(testTimeout):
+		t.Fatalf("no bridge rendered")
+	}
+
+	// The bridge is longer than a part, but cut in parts no longer than the target duration.
+	duration := bridge.tail.seg.Duration + bridge.head.seg.Duration - bridge.overlap
+	if bridge.overlap != stream.Crossfade.Seconds() || duration <= options.SegmentTime.Seconds() {
+		t.Fatalf("got a bridge of %.3fs overlapping %.3fs, expected one longer than a part", duration, bridge.overlap)
+	}
+	if len(bridge.parts) != 2 {
+		t.Fatalf("got %d bridge parts, expected 2", len(bridge.parts))
+	}
+	var total float64
+	for _, part := range bridge.parts {
+		if part.seg.Duration > options.SegmentTime.Seconds() {
+			t.Errorf("got a bridge part of %.3fs, expected at most %s", part.seg.Duration, options.SegmentTime)
+		}
+		total += part.seg.Duration
+	}
+	if math.Abs(total-duration) > 1e-3 {
+		t.Errorf("got bridge parts of %.3fs, expected %.3fs", total, duration)
+	}
+
+	// Wait for the part following the bridge.
+	var previous, next *Track
+	deadline := time.Now().Add(testTimeout)
+	for next == nil {
+		stream.RLock()
+		for i, track := range stream.queue {
+			if i > 0 && len(track.parts) > len(bridge.parts) && track.parts[0] == bridge.parts[0] {
+				previous, next = stream.queue[i-1], track
+			}
+		}
+		stream.RUnlock()
+
+		if next == nil && time.Now().After(deadline) {
+			t.Fatalf("bridge not followed by the next track")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stream.RLock()
+	defer stream.RUnlock()
+
+	// The tail of the previous track is replaced by the bridge.
+	checkIndexes(t, previous)
+	for _, part := range previous.parts {
+		if part == bridge.tail {
+			t.Errorf("tail %s published with the bridge", part.seg.URI)
+		}
+	}
+
+	// The bridge takes the first indexes of the next track, and both of its ends are marked as discontinuities.
+	checkIndexes(t, next)
+	for i, part := range next.parts[:len(bridge.parts)+1] {
+		if i < len(bridge.parts) && part != bridge.parts[i] {
+			t.Errorf("part %s is not part %d of the bridge", part.seg.URI, i)
+		}
+		if discontinuity := i == 0 || i == len(bridge.parts); part.seg.Discontinuity != discontinuity {
+			t.Errorf("got discontinuity %t for part %s, expected %t", part.seg.Discontinuity, part.seg.URI, discontinuity)
+		}
+	}
+}
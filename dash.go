@@ -0,0 +1,461 @@
+package musiko
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+const (
+	aacFrameSamples = 1024
+	dashProfile     = "urn:mpeg:dash:profile:isoff-live:2011"
+	dashChannels    = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+)
+
+var (
+	ErrDASHUnsupported = errors.New("only aac tracks can be streamed with dash")
+)
+
+var adtsFrequencies = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// DASHURIModifier returns the base URI of the DASH segments of a track, followed by "init.mp4" and "<index>.m4s".
+type DASHURIModifier func(string) string
+
+// dashConfig describes the audio of a track in the fMP4 segments, read from the ADTS header of its first part.
+type dashConfig struct {
+	timescale uint32 // Sample rate.
+	channels  byte
+	specific  []byte // AudioSpecificConfig.
+	codecs    string
+}
+
+// newDASHConfig returns the config of the AAC audio of a TS part, nil if the part cannot be streamed with DASH.
+func newDASHConfig(data []byte, codecs string) *dashConfig {
+	audio, contentType, err := tsAudio(data)
+	if err != nil || contentType != audioContentTypes[tsStreamADTS] || len(audio) < 7 {
+		return nil
+	}
+
+	objectType := audio[2]>>6 + 1
+	frequencyIndex := audio[2] >> 2 & 0x0F
+	channels := (audio[2]&0x01)<<2 | audio[3]>>6
+	// The sample entry holds the rate in 16.16 fixed point, 88.2kHz and 96kHz do not fit.
+	if int(frequencyIndex) >= len(adtsFrequencies) || adtsFrequencies[frequencyIndex] > math.MaxUint16 {
+		return nil
+	}
+
+	c := new(dashConfig)
+	c.timescale = adtsFrequencies[frequencyIndex]
+	c.channels = channels
+	c.specific = []byte{objectType<<3 | frequencyIndex>>1, (frequencyIndex&0x01)<<7 | channels<<3}
+	c.codecs = codecs
+	if c.codecs == "" {
+		c.codecs = fmt.Sprintf("mp4a.40.%d", objectType)
+	}
+
+	return c
+}
+
+// duration returns the duration of a part in timescale units.
+func (c *dashConfig) duration(part *Part) uint64 {
+	return uint64(math.Round(part.seg.Duration * float64(c.timescale)))
+}
+
+// decodeTime returns the start of a part of the track in timescale units.
+func (c *dashConfig) decodeTime(track *Track, index int) uint64 {
+	var start uint64
+	for _, part := range track.parts[:index] {
+		start += c.duration(part)
+	}
+	return start
+}
+
+type mpd struct {
+	XMLName                    xml.Name    `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                   string      `xml:"profiles,attr"`
+	Type                       string      `xml:"type,attr"`
+	AvailabilityStartTime      string      `xml:"availabilityStartTime,attr"`
+	PublishTime                string      `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string      `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string      `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string      `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string      `xml:"suggestedPresentationDelay,attr"`
+	Periods                    []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Id         string `xml:"id,attr"`
+	Start      string `xml:"start,attr"`
+	Adaptation struct {
+		MimeType         string `xml:"mimeType,attr"`
+		Lang             string `xml:"lang,attr"`
+		SegmentAlignment bool   `xml:"segmentAlignment,attr"`
+		Representation   struct {
+			Id                string `xml:"id,attr"`
+			Codecs            string `xml:"codecs,attr"`
+			Bandwidth         int    `xml:"bandwidth,attr"`
+			AudioSamplingRate uint32 `xml:"audioSamplingRate,attr"`
+			Channels          struct {
+				Scheme string `xml:"schemeIdUri,attr"`
+				Value  byte   `xml:"value,attr"`
+			} `xml:"AudioChannelConfiguration"`
+			Template struct {
+				Timescale      uint32       `xml:"timescale,attr"`
+				Initialization string       `xml:"initialization,attr"`
+				Media          string       `xml:"media,attr"`
+				StartNumber    int          `xml:"startNumber,attr"`
+				Timeline       []mpdSegment `xml:"SegmentTimeline>S"`
+			} `xml:"SegmentTemplate"`
+		} `xml:"Representation"`
+	} `xml:"AdaptationSet"`
+}
+
+// mpdSegment is a part in the timeline of its track, the time being only set on the first one.
+type mpdSegment struct {
+	Time     *uint64 `xml:"t,attr"`
+	Duration uint64  `xml:"d,attr"`
+}
+
+// dashEntry is a part listed in the manifest.
+type dashEntry struct {
+	track *Track
+	index int
+	part  *Part
+}
+
+// dashEntries returns the parts of the manifest: the DVR window or the played parts of the head track, and the live window.
+// Must be called with the stream locked for reading.
+func (s *Stream) dashEntries() []dashEntry {
+	var entries []dashEntry
+
+	if s.options.DVRWindow > 0 {
+		for _, kept := range s.dvr {
+			entries = append(entries, dashEntry{kept.track, kept.index, kept.part})
+		}
+	} else if len(s.queue) > 0 {
+		// The played parts of the head track are kept until it is finished.
+		head := s.queue[0]
+		for i := 0; i < len(head.parts)-len(head.queue); i++ {
+			entries = append(entries, dashEntry{head, i, head.parts[i]})
+		}
+	}
+
+	listed := 0
+	for _, track := range s.queue {
+		played := len(track.parts) - len(track.queue)
+		for i, part := range track.queue {
+			if listed == s.options.WindowSize {
+				return entries
+			}
+			entries = append(entries, dashEntry{track, played + i, part})
+			listed++
+		}
+	}
+
+	return entries
+}
+
+// WriteManifest writes a dynamic DASH manifest of the main rendition, with a period for each track.
+// Tracks that cannot be streamed with DASH are left out, returns ErrDASHUnsupported if none of the listed tracks can.
+func (s *Stream) WriteManifest(writer io.Writer) (int, error) {
+	s.RLock()
+
+	if s.renditions == nil {
+		s.RUnlock()
+		return 0, ErrPlaylistEmpty
+	}
+
+	manifest := mpd{
+		Profiles:                   dashProfile,
+		Type:                       "dynamic",
+		AvailabilityStartTime:      time.Unix(0, 0).UTC().Format(time.RFC3339),
+		PublishTime:                time.Now().UTC().Format(time.RFC3339),
+		MinimumUpdatePeriod:        isoDuration(s.options.SegmentTime.Seconds()),
+		MinBufferTime:              isoDuration(2 * s.options.SegmentTime.Seconds()),
+		SuggestedPresentationDelay: isoDuration(3 * s.options.SegmentTime.Seconds()),
+	}
+
+	var (
+		depth   float64
+		skipped bool
+	)
+	entries := s.dashEntries()
+	for start := 0; start < len(entries); {
+		// Consecutive parts of a track.
+		track := entries[start].track
+		end := start + 1
+		for end < len(entries) && entries[end].track == track {
+			end++
+		}
+		group := entries[start:end]
+		start = end
+
+		for _, entry := range group {
+			depth += entry.part.seg.Duration
+		}
+
+		// Periods start at the date of their track, the next one starts in time after a skipped track.
+		config := track.dash
+		if config == nil {
+			skipped = true
+			continue
+		}
+
+		// The period starts with the date range of the track, which never changes once listed.
+		periodStart := track.dateRange.start.Sub(time.Unix(0, 0)).Seconds()
+
+		var period mpdPeriod
+		period.Id = track.id.String()
+		period.Start = isoDuration(periodStart)
+		period.Adaptation.MimeType = "audio/mp4"
+		period.Adaptation.Lang = "und"
+		period.Adaptation.SegmentAlignment = true
+
+		representation := &period.Adaptation.Representation
+		representation.Id = s.renditions[0].name
+		representation.Codecs = config.codecs
+		representation.Bandwidth = s.renditions[0].bandwidth()
+		representation.AudioSamplingRate = config.timescale
+		representation.Channels.Scheme = dashChannels
+		representation.Channels.Value = config.channels
+
+		base := track.id.String() + "/"
+		if s.DASHURIModifier != nil {
+			base = s.DASHURIModifier(track.id.String())
+		}
+		template := &representation.Template
+		template.Timescale = config.timescale
+		template.Initialization = base + "init.mp4"
+		template.Media = base + "$Number$.m4s"
+		template.StartNumber = group[0].index
+
+		first := config.decodeTime(track, group[0].index)
+		for i, entry := range group {
+			segment := mpdSegment{Duration: config.duration(entry.part)}
+			if i == 0 {
+				segment.Time = &first
+			}
+			template.Timeline = append(template.Timeline, segment)
+		}
+
+		manifest.Periods = append(manifest.Periods, period)
+	}
+
+	s.RUnlock()
+
+	if len(manifest.Periods) == 0 && skipped {
+		return 0, ErrDASHUnsupported
+	}
+	if len(manifest.Periods) == 0 {
+		return 0, ErrPlaylistEmpty
+	}
+	manifest.TimeShiftBufferDepth = isoDuration(depth)
+
+	data, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	return writer.Write(append([]byte(xml.Header), data...))
+}
+
+func isoDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
+
+// dashTrack returns a track with its DASH config, if listed in the stream.
+func (s *Stream) dashTrack(trackId string) (*Track, *dashConfig, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	track, exists := s.tracks[trackId]
+	if !exists {
+		return nil, nil, ErrTrackNotFound
+	}
+	if track.dash == nil {
+		return nil, nil, ErrDASHUnsupported
+	}
+
+	return track, track.dash, nil
+}
+
+// WriteInitSegment writes the fMP4 initialization segment of a track.
+func (s *Stream) WriteInitSegment(writer io.Writer, trackId string) (int, error) {
+	_, config, err := s.dashTrack(trackId)
+	if err != nil {
+		return 0, err
+	}
+
+	return writer.Write(initSegment(config))
+}
+
+// WriteMediaSegment writes a part of a track as a fMP4 media segment.
+func (s *Stream) WriteMediaSegment(writer io.Writer, trackId string, index int) (int, error) {
+	track, config, err := s.dashTrack(trackId)
+	if err != nil {
+		return 0, err
+	}
+
+	s.RLock()
+	if index < 0 || index >= len(track.parts) {
+		s.RUnlock()
+		return 0, ErrPartNotFound
+	}
+	decodeTime := config.decodeTime(track, index)
+	s.RUnlock()
+
+	r, err := s.openPart(trackId, index)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	audio, _, err := tsAudio(data)
+	if err != nil {
+		return 0, err
+	}
+	frames, err := adtsFrames(audio)
+	if err != nil {
+		return 0, err
+	}
+
+	return writer.Write(mediaSegment(uint32(index+1), decodeTime, frames))
+}
+
+// adtsFrames returns the raw AAC frames of an ADTS stream.
+func adtsFrames(data []byte) ([][]byte, error) {
+	var frames [][]byte
+
+	for len(data) > 0 {
+		if len(data) < 7 || data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+			return nil, ErrInvalidTS
+		}
+
+		header := 7
+		if data[1]&0x01 == 0 {
+			// CRC.
+			header = 9
+		}
+		length := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		if length < header || length > len(data) {
+			return nil, ErrInvalidTS
+		}
+
+		frames = append(frames, data[header:length])
+		data = data[length:]
+	}
+
+	return frames, nil
+}
+
+func initSegment(config *dashConfig) []byte {
+	matrix := u32s(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000)
+
+	mvhd := fullBox("mvhd", 0, 0, u32s(0, 0, 1000, 0, 0x00010000), u16s(0x0100, 0), u32s(0, 0), matrix, make([]byte, 24), u32s(2))
+	tkhd := fullBox("tkhd", 0, 0x03, u32s(0, 0, 1, 0, 0, 0, 0), u16s(0, 0, 0x0100, 0), matrix, u32s(0, 0))
+	mdhd := fullBox("mdhd", 0, 0, u32s(0, 0, config.timescale, 0), u16s(0x55C4, 0)) // Undetermined language.
+	hdlr := fullBox("hdlr", 0, 0, u32s(0), []byte("soun"), u32s(0, 0, 0), []byte("SoundHandler\x00"))
+
+	// ES descriptor, with the decoder config of MPEG-4 audio and the predefined SL config.
+	decoderSpecific := descriptor(0x05, config.specific)
+	decoderConfig := descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, u32s(0, 0), decoderSpecific)
+	esds := fullBox("esds", 0, 0, descriptor(0x03, u16s(0), []byte{0}, decoderConfig, descriptor(0x06, []byte{0x02})))
+	mp4a := box("mp4a", make([]byte, 6), u16s(1), u32s(0, 0), u16s(uint16(config.channels), 16, 0, 0), u32s(config.timescale<<16), esds)
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32s(1), mp4a),
+		fullBox("stts", 0, 0, u32s(0)),
+		fullBox("stsc", 0, 0, u32s(0)),
+		fullBox("stsz", 0, 0, u32s(0, 0)),
+		fullBox("stco", 0, 0, u32s(0)),
+	)
+	dinf := box("dinf", fullBox("dref", 0, 0, u32s(1), fullBox("url ", 0, 0x01)))
+	minf := box("minf", fullBox("smhd", 0, 0, u16s(0, 0)), dinf, stbl)
+
+	trex := fullBox("trex", 0, 0, u32s(1, 1, aacFrameSamples, 0, 0))
+	moov := box("moov", mvhd, box("trak", tkhd, box("mdia", mdhd, hdlr, minf)), box("mvex", trex))
+
+	return append(box("ftyp", []byte("iso6"), u32s(0), []byte("iso6mp41dash")), moov...)
+}
+
+func mediaSegment(sequence uint32, decodeTime uint64, frames [][]byte) []byte {
+	mdat := new(bytes.Buffer)
+	samples := new(bytes.Buffer)
+	for _, frame := range frames {
+		mdat.Write(frame)
+		samples.Write(u32s(aacFrameSamples, uint32(len(frame))))
+	}
+
+	tfdt := make([]byte, 8)
+	binary.BigEndian.PutUint64(tfdt, decodeTime)
+
+	// The data offset is relative to the moof, whose size does not depend on it.
+	trun := func(offset uint32) []byte {
+		return fullBox("trun", 0, 0x000301, u32s(uint32(len(frames)), offset), samples.Bytes())
+	}
+	moof := func(offset uint32) []byte {
+		traf := box("traf", fullBox("tfhd", 0, 0x020000, u32s(1)), fullBox("tfdt", 1, 0, tfdt), trun(offset))
+		return box("moof", fullBox("mfhd", 0, 0, u32s(sequence)), traf)
+	}
+	size := len(moof(0))
+
+	return append(append(box("styp", []byte("msdh"), u32s(0), []byte("msdhmsix")), moof(uint32(size+8))...), box("mdat", mdat.Bytes())...)
+}
+
+func box(kind string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+
+	data := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(data, uint32(size))
+	copy(data[4:], kind)
+	for _, payload := range payloads {
+		data = append(data, payload...)
+	}
+
+	return data
+}
+
+func fullBox(kind string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(kind, append([][]byte{header}, payloads...)...)
+}
+
+// descriptor builds an MPEG-4 descriptor, with its size on one byte.
+func descriptor(tag byte, payloads ...[]byte) []byte {
+	data := []byte{tag, 0}
+	for _, payload := range payloads {
+		data = append(data, payload...)
+	}
+	data[1] = byte(len(data) - 2)
+
+	return data
+}
+
+func u32s(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[4*i:], value)
+	}
+	return data
+}
+
+func u16s(values ...uint16) []byte {
+	data := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(data[2*i:], value)
+	}
+	return data
+}
@@ -0,0 +1,267 @@
+package musiko
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"github.com/scotow/musiko/pandoratest"
+	"testing"
+	"time"
+)
+
+// testDASHPart returns the first TS part of a silent track, with the raw AAC frames of its audio.
+func testDASHPart(t *testing.T) ([]byte, [][]byte) {
+	t.Helper()
+
+	_, parts, err := NativeSplitTS(pandoratest.SilentM4A(5*time.Second), defaultSegmentTime)
+	if err != nil {
+		t.Fatalf("cannot split: %s", err)
+	}
+	audio, _, err := tsAudio(parts[0].data)
+	if err != nil {
+		t.Fatalf("cannot extract audio: %s", err)
+	}
+	frames, err := adtsFrames(audio)
+	if err != nil {
+		t.Fatalf("cannot read frames: %s", err)
+	}
+
+	return parts[0].data, frames
+}
+
+func TestInitSegment(t *testing.T) {
+	data, _ := testDASHPart(t)
+	config := newDASHConfig(data, "")
+	if config == nil {
+		t.Fatalf("aac part not streamable with dash")
+	}
+	if config.timescale != 44100 || config.channels != 2 || config.codecs != "mp4a.40.2" {
+		t.Errorf("got config %+v, expected AAC-LC 44100Hz stereo", config)
+	}
+
+	init := initSegment(config)
+	if _, err := mp4Path(init, "ftyp"); err != nil {
+		t.Errorf("no ftyp box: %s", err)
+	}
+	if _, err := mp4Path(init, "moov", "mvex", "trex"); err != nil {
+		t.Errorf("no trex box: %s", err)
+	}
+
+	// The sample description is read back as the one of the demuxed track.
+	trak, err := mp4Path(init, "moov", "trak")
+	if err != nil {
+		t.Fatalf("no trak box: %s", err)
+	}
+	mdhd, err := mp4Path(trak, "mdia", "mdhd")
+	if err != nil || binary.BigEndian.Uint32(mdhd[12:]) != 44100 {
+		t.Errorf("invalid mdhd box: %v", err)
+	}
+	stsd, err := mp4Path(trak, "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		t.Fatalf("no stsd box: %s", err)
+	}
+	parsed, err := parseSampleDescription(stsd)
+	if err != nil {
+		t.Fatalf("cannot parse sample description: %s", err)
+	}
+	if parsed != (aacConfig{profile: 2, objectType: 2, frequencyIndex: 4, channels: 2}) {
+		t.Errorf("got config %+v, expected AAC-LC 44100Hz stereo", parsed)
+	}
+}
+
+func TestDASHConfigSampleRate(t *testing.T) {
+	data, _ := testDASHPart(t)
+	audio, _, err := tsAudio(data)
+	if err != nil {
+		t.Fatalf("cannot extract audio: %s", err)
+	}
+	header := bytes.Index(data, audio[:7])
+
+	tests := []struct {
+		frequencyIndex byte
+		timescale      uint32
+	}{
+		{0, 0},     // 96kHz.
+		{1, 0},     // 88.2kHz.
+		{2, 64000}, // 64kHz.
+		{3, 48000}, // 48kHz.
+	}
+	for _, test := range tests {
+		// The rate is read from the ADTS header of the first frame.
+		patched := append([]byte(nil), data...)
+		patched[header+2] = patched[header+2]&^0x3C | test.frequencyIndex<<2
+
+		config := newDASHConfig(patched, "")
+		if test.timescale == 0 && config != nil {
+			t.Errorf("got timescale %d for %dHz, expected the part not streamable", config.timescale, adtsFrequencies[test.frequencyIndex])
+		}
+		if test.timescale != 0 && (config == nil || config.timescale != test.timescale) {
+			t.Errorf("got config %+v for %dHz, expected timescale %d", config, adtsFrequencies[test.frequencyIndex], test.timescale)
+		}
+	}
+}
+
+func TestMediaSegment(t *testing.T) {
+	_, frames := testDASHPart(t)
+
+	segment := mediaSegment(3, 88200, frames)
+	boxes, err := mp4Boxes(segment)
+	if err != nil {
+		t.Fatalf("invalid segment: %s", err)
+	}
+	if len(boxes) != 3 || boxes[0].kind != "styp" || boxes[1].kind != "moof" || boxes[2].kind != "mdat" {
+		t.Fatalf("got boxes %v, expected styp, moof and mdat", boxes)
+	}
+
+	moof := boxes[1].data
+	mfhd, err := mp4Child(moof, "mfhd")
+	if err != nil || binary.BigEndian.Uint32(mfhd[4:]) != 3 {
+		t.Errorf("invalid mfhd box: %v", err)
+	}
+	tfdt, err := mp4Path(moof, "traf", "tfdt")
+	if err != nil || tfdt[0] != 1 || binary.BigEndian.Uint64(tfdt[4:]) != 88200 {
+		t.Errorf("invalid tfdt box: %v", err)
+	}
+
+	trun, err := mp4Path(moof, "traf", "trun")
+	if err != nil {
+		t.Fatalf("no trun box: %s", err)
+	}
+	count := int(binary.BigEndian.Uint32(trun[4:]))
+	if count != len(frames) || len(trun) != 12+8*count {
+		t.Fatalf("trun has %d samples, expected %d", count, len(frames))
+	}
+
+	// The data offset, relative to the moof, points to the payload of the mdat.
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+	mdatStart := len(segment) - len(boxes[2].data)
+	moofStart := mdatStart - 8 - len(moof) - 8
+	if moofStart+offset != mdatStart {
+		t.Fatalf("data offset %d does not point to the mdat", offset)
+	}
+
+	mdat := boxes[2].data
+	for i, frame := range frames {
+		duration := binary.BigEndian.Uint32(trun[12+8*i:])
+		size := int(binary.BigEndian.Uint32(trun[16+8*i:]))
+		if duration != aacFrameSamples || size != len(frame) || !bytes.Equal(mdat[:size], frame) {
+			t.Fatalf("sample %d does not match its frame", i)
+		}
+		mdat = mdat[size:]
+	}
+	if len(mdat) != 0 {
+		t.Errorf("%d bytes of mdat not referenced", len(mdat))
+	}
+}
+
+func TestADTSFramesInvalid(t *testing.T) {
+	data, _ := testDASHPart(t)
+	audio, _, err := tsAudio(data)
+	if err != nil {
+		t.Fatalf("cannot extract audio: %s", err)
+	}
+
+	tests := map[string][]byte{
+		"no sync word":      append([]byte{0x00}, audio...),
+		"truncated header":  audio[:5],
+		"truncated payload": audio[:len(audio)-1],
+	}
+	for name, data := range tests {
+		if _, err := adtsFrames(data); err != ErrInvalidTS {
+			t.Errorf("%s: got %v, expected %v", name, err, ErrInvalidTS)
+		}
+	}
+}
+
+// testManifest writes and decodes the manifest of a stream.
+func testManifest(t *testing.T, stream *Stream) mpd {
+	t.Helper()
+
+	buffer := new(bytes.Buffer)
+	_, err := stream.WriteManifest(buffer)
+	if err != nil {
+		t.Fatalf("cannot write manifest: %s", err)
+	}
+
+	var manifest mpd
+	err = xml.Unmarshal(buffer.Bytes(), &manifest)
+	if err != nil {
+		t.Fatalf("invalid manifest: %s", err)
+	}
+	return manifest
+}
+
+func TestStreamManifest(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{WindowSize: 20}, nil)
+	waitQueued(t, stream, 2)
+
+	manifest := testManifest(t, stream)
+	if manifest.Type != "dynamic" || len(manifest.Periods) < 2 {
+		t.Fatalf("got %s manifest with %d periods, expected a dynamic one with several tracks", manifest.Type, len(manifest.Periods))
+	}
+
+	// Each period starts where the previous one ends.
+	var end time.Duration
+	for i, period := range manifest.Periods {
+		var seconds float64
+		_, err := fmt.Sscanf(period.Start, "PT%fS", &seconds)
+		if err != nil {
+			t.Fatalf("invalid period start %s", period.Start)
+		}
+		start := time.Duration(seconds * float64(time.Second))
+		if i > 0 && (start-end > time.Millisecond || end-start > time.Millisecond) {
+			t.Errorf("period %d starts at %s, expected %s", i, start, end)
+		}
+
+		template := period.Adaptation.Representation.Template
+		if template.Timescale != 44100 || len(template.Timeline) == 0 || template.Timeline[0].Time == nil {
+			t.Fatalf("invalid segment template of period %d", i)
+		}
+		var duration uint64
+		for _, segment := range template.Timeline {
+			duration += segment.Duration
+		}
+		end = start + time.Duration(float64(duration)/float64(template.Timescale)*float64(time.Second))
+	}
+}
+
+func TestStreamManifestUnsupported(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{WindowSize: 20}, nil)
+	waitQueued(t, stream, 2)
+
+	// A track that cannot be streamed with DASH is left out, the periods of the others keep their start.
+	stream.Lock()
+	unsupported := stream.queue[1]
+	unsupported.dash = nil
+	stream.Unlock()
+
+	manifest := testManifest(t, stream)
+	if len(manifest.Periods) == 0 {
+		t.Fatalf("got no periods, expected the ones of the supported tracks")
+	}
+	stream.RLock()
+	for _, period := range manifest.Periods {
+		if period.Id == unsupported.id.String() {
+			t.Errorf("period of the unsupported track %s listed", period.Id)
+		}
+		if expected := isoDuration(stream.tracks[period.Id].dateRange.start.Sub(time.Unix(0, 0)).Seconds()); period.Start != expected {
+			t.Errorf("period %s starts at %s, expected %s", period.Id, period.Start, expected)
+		}
+	}
+	stream.RUnlock()
+
+	// Nothing can be streamed once no track is supported.
+	stream.Lock()
+	for _, track := range stream.queue {
+		track.dash = nil
+	}
+	stream.Unlock()
+
+	_, err := stream.WriteManifest(new(bytes.Buffer))
+	if err != ErrDASHUnsupported {
+		t.Errorf("got error %v, expected %v", err, ErrDASHUnsupported)
+	}
+}
@@ -0,0 +1,176 @@
+package musiko
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"strings"
+	"time"
+)
+
+const (
+	dateRangeClass = "com.scotow.musiko.track"
+)
+
+// dateRange marks the span of a track in the playlists with an EXT-X-DATERANGE tag.
+// The duration is only known once all the parts of the track are published. If the start was already listed by then,
+// it is sent in another tag with the same ID, since the listed tags cannot change.
+type dateRange struct {
+	id       string
+	start    time.Time
+	duration float64
+	info     TrackInfo
+	end      bool // Only sets the duration of the range started by a previous tag.
+}
+
+func (d *dateRange) TagName() string {
+	return "#EXT-X-DATERANGE:"
+}
+
+func (d *dateRange) Encode() *bytes.Buffer {
+	buffer := new(bytes.Buffer)
+
+	buffer.WriteString(d.TagName())
+	fmt.Fprintf(buffer, `ID="%s",CLASS="%s",START-DATE="%s"`, d.id, dateRangeClass, d.start.Format(m3u8.DATETIME))
+	if d.duration > 0 {
+		fmt.Fprintf(buffer, ",DURATION=%.3f", d.duration)
+	}
+	if d.end {
+		return buffer
+	}
+
+	fmt.Fprintf(buffer, `,X-TRACK-ID="%s"`, d.id)
+	for _, attribute := range []struct {
+		name  string
+		value string
+	}{
+		{"X-ARTIST", d.info.Artist},
+		{"X-ALBUM", d.info.Album},
+		{"X-TITLE", d.info.Name},
+		{"X-COVER", d.info.Cover},
+	} {
+		if attribute.value != "" {
+			fmt.Fprintf(buffer, `,%s="%s"`, attribute.name, quotedString(attribute.value))
+		}
+	}
+
+	return buffer
+}
+
+func (d *dateRange) String() string {
+	return d.Encode().String()
+}
+
+// dateRanges are the EXT-X-DATERANGE tags of a segment, in order.
+type dateRanges []*dateRange
+
+func (d dateRanges) TagName() string {
+	return "#EXT-X-DATERANGE:"
+}
+
+func (d dateRanges) Encode() *bytes.Buffer {
+	buffer := new(bytes.Buffer)
+	for i, tag := range d {
+		if i > 0 {
+			buffer.WriteByte('\n')
+		}
+		buffer.Write(tag.Encode().Bytes())
+	}
+
+	return buffer
+}
+
+func (d dateRanges) String() string {
+	return d.Encode().String()
+}
+
+// quotedString removes the characters not allowed in the quoted strings of the playlists.
+func quotedString(value string) string {
+	return strings.NewReplacer(`"`, "'", "\r", " ", "\n", " ").Replace(value)
+}
+
+// stamp sets the program date time of the parts entering the live window, which never changes once listed.
+// Marks the start of a track on its first part, and the ends of the ranges already listed on the next part.
+// Must be called with the stream locked.
+func (s *Stream) stamp() {
+	// The head part plays since currentStart, or starts now.
+	start := time.Now()
+
+	listed := 0
+	for _, track := range s.queue {
+		played := len(track.parts) - len(track.queue)
+		for i, part := range track.queue {
+			if listed == s.options.WindowSize {
+				return
+			}
+			if listed == 0 && part == s.current {
+				start = s.currentStart
+			}
+			listed++
+
+			// The new parts follow the ones already listed.
+			if part.stamped {
+				start = part.seg.ProgramDateTime
+			} else {
+				s.stampPart(track, part, played+i, start)
+			}
+			start = start.Add(seconds(part.seg.Duration))
+		}
+	}
+}
+
+// stampPart sets the program date time of a part expected to play at start. The parts of a track follow each other,
+// pauses and skips only move the next parts starting with a discontinuity.
+func (s *Stream) stampPart(track *Track, part *Part, index int, start time.Time) {
+	if index > 0 && !part.seg.Discontinuity {
+		previous := track.parts[index-1].seg
+		start = previous.ProgramDateTime.Add(seconds(previous.Duration))
+	}
+	part.stamped = true
+
+	tags := dateRanges(s.rangeEnds)
+	s.rangeEnds = nil
+	if index == 0 {
+		track.dateRange = &dateRange{id: track.id.String(), start: start, info: track.info}
+		if track.complete {
+			track.dateRange.duration = track.duration()
+		}
+		tags = append(tags, track.dateRange)
+	}
+
+	for _, seg := range part.renditions {
+		seg.ProgramDateTime = start
+		if len(tags) > 0 {
+			seg.Custom = map[string]m3u8.CustomTag{tags.TagName(): tags}
+		}
+	}
+}
+
+// endDateRange sets the duration of the span of a fully published track, in another tag if its start is already listed.
+// Must be called with the stream locked.
+func (s *Stream) endDateRange(track *Track) {
+	if track.dateRange == nil {
+		return
+	}
+
+	end := *track.dateRange
+	end.duration = track.duration()
+	end.end = true
+	s.rangeEnds = append(s.rangeEnds, &end)
+
+	// The last part of the track may be the next one listed.
+	s.stamp()
+}
+
+// duration returns the duration of the published parts of the track.
+func (t *Track) duration() float64 {
+	var duration float64
+	for _, part := range t.parts {
+		duration += part.seg.Duration
+	}
+	return duration
+}
+
+func seconds(duration float64) time.Duration {
+	return time.Duration(duration * float64(time.Second))
+}
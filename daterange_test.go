@@ -0,0 +1,78 @@
+package musiko
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// playlistBlocks returns the tags preceding each segment URI of the main playlist.
+func playlistBlocks(t *testing.T, stream *Stream) map[string]string {
+	t.Helper()
+
+	buffer := new(bytes.Buffer)
+	_, err := stream.WritePlaylist(buffer)
+	if err != nil {
+		t.Fatalf("cannot write playlist: %s", err)
+	}
+
+	blocks := make(map[string]string)
+	var tags []string
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME"), strings.HasPrefix(line, "#EXT-X-DATERANGE"), strings.HasPrefix(line, "#EXTINF"):
+			tags = append(tags, line)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			blocks[line] = strings.Join(tags, "\n")
+			tags = nil
+		}
+	}
+	return blocks
+}
+
+func TestStreamListedPartsNeverChange(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{WindowSize: 4}, nil)
+
+	before := playlistBlocks(t, stream)
+	if len(before) != 4 {
+		t.Fatalf("got %d segments, expected 4", len(before))
+	}
+	for uri, block := range before {
+		if !strings.Contains(block, "#EXT-X-PROGRAM-DATE-TIME") {
+			t.Errorf("segment %s has no program date time", uri)
+		}
+	}
+
+	// Skips and pauses only move the parts listed afterwards.
+	skip(t, stream)
+	if err := stream.Pause(); err != nil {
+		t.Fatalf("cannot pause: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := stream.Resume(); err != nil {
+		t.Fatalf("cannot resume: %s", err)
+	}
+
+	after := playlistBlocks(t, stream)
+	for uri, block := range after {
+		if previous, listed := before[uri]; listed && previous != block {
+			t.Errorf("segment %s changed from:\n%s\nto:\n%s", uri, previous, block)
+		}
+	}
+}
+
+func TestDateRangeEnd(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tags := dateRanges{
+		{id: "a", start: start, duration: 12.5, end: true, info: TrackInfo{Name: "A"}},
+		{id: "b", start: start.Add(12500 * time.Millisecond), info: TrackInfo{Artist: "Artist", Name: "B"}},
+	}
+
+	expected := `#EXT-X-DATERANGE:ID="a",CLASS="com.scotow.musiko.track",START-DATE="2020-01-01T00:00:00Z",DURATION=12.500` + "\n" +
+		`#EXT-X-DATERANGE:ID="b",CLASS="com.scotow.musiko.track",START-DATE="2020-01-01T00:00:12.5Z",X-TRACK-ID="b",X-ARTIST="Artist",X-TITLE="B"`
+	if encoded := tags.String(); encoded != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", encoded, expected)
+	}
+}
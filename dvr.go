@@ -0,0 +1,202 @@
+package musiko
+
+import (
+	"errors"
+	"github.com/grafov/m3u8"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+var (
+	ErrDVRDisabled = errors.New("dvr disabled on this stream")
+)
+
+// dvrPart is a played part kept for rewinding.
+type dvrPart struct {
+	track *Track
+	index int
+	part  *Part
+}
+
+// dvrStore returns the store of the played parts.
+func (s *Stream) dvrStore() PartStore {
+	if s.DVRStore != nil {
+		return s.DVRStore
+	}
+	return s.Store
+}
+
+// partKeys returns the keys of a part in every rendition of its track.
+func partKeys(track *Track, index int) []string {
+	keys := []string{partKey(track, index)}
+	for _, alternate := range track.alternates {
+		keys = append(keys, partKey(alternate, index))
+	}
+
+	return keys
+}
+
+// keepPart moves a played part to the DVR store, and drops the parts older than the DVR window.
+// Must be called with the stream locked.
+func (s *Stream) keepPart(track *Track, index int, part *Part) {
+	if s.DVRStore != nil && s.DVRStore != s.Store {
+		for _, key := range partKeys(track, index) {
+			err := s.moveData(key)
+			if err != nil && err != ErrDataNotFound {
+				log.Printf("Cannot move data to the DVR store: %s (%s).\n", err.Error(), s.id.String())
+			}
+		}
+	}
+
+	s.dvr = append(s.dvr, dvrPart{track: track, index: index, part: part})
+	s.dvrDuration += part.seg.Duration
+	track.rewind++
+	track.kept++
+
+	for len(s.dvr) > 1 && s.dvrDuration > s.options.DVRWindow.Seconds() {
+		s.dropPart()
+	}
+}
+
+func (s *Stream) moveData(key string) error {
+	r, err := s.Store.Open(key)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return err
+	}
+
+	err = s.DVRStore.Put(key, data)
+	if err != nil {
+		return err
+	}
+
+	return s.Store.Remove(key)
+}
+
+// dropPart releases the oldest part kept for rewinding, and its track once it has no part left.
+// Must be called with the stream locked.
+func (s *Stream) dropPart() {
+	kept := s.dvr[0]
+	s.dvr[0] = dvrPart{}
+	s.dvr = s.dvr[1:]
+	s.dvrDuration -= kept.part.seg.Duration
+
+	for _, key := range partKeys(kept.track, kept.index) {
+		// The data stays in the main store if it could not be moved.
+		err := s.dvrStore().Remove(key)
+		if err == ErrDataNotFound && s.DVRStore != nil {
+			err = s.Store.Remove(key)
+		}
+		if err != nil && err != ErrDataNotFound {
+			log.Printf("Cannot remove data from store: %s (%s).\n", err.Error(), s.id.String())
+		}
+	}
+
+	kept.track.rewind--
+	if kept.track.rewind == 0 && kept.track.released {
+		delete(s.tracks, kept.track.id.String())
+	}
+}
+
+// openData opens the data of a part, wherever it is stored.
+func (s *Stream) openData(key string) (io.ReadCloser, error) {
+	r, err := s.Store.Open(key)
+	if err == ErrDataNotFound && s.DVRStore != nil {
+		return s.DVRStore.Open(key)
+	}
+
+	return r, err
+}
+
+// dvrPlaylist builds the playlist of a rendition listing the parts kept for rewinding, followed by the live window.
+// Must be called with the stream locked for reading.
+func (s *Stream) dvrPlaylist(r int) (*m3u8.MediaPlaylist, error) {
+	live := s.renditions[r].playlist
+
+	segments := make([]*m3u8.MediaSegment, 0, len(s.dvr)+s.options.WindowSize)
+	discontinuities := uint64(0)
+	for _, kept := range s.dvr {
+		seg := kept.part.renditions[r]
+		if seg.Discontinuity {
+			discontinuities++
+		}
+		segments = append(segments, seg)
+	}
+	for _, track := range s.queue {
+		for _, part := range track.queue {
+			if len(segments) == cap(segments) {
+				break
+			}
+			segments = append(segments, part.renditions[r])
+		}
+	}
+
+	// List all the segments, the window being the DVR one.
+	playlist, err := m3u8.NewMediaPlaylist(0, uint(len(segments)+1))
+	if err != nil {
+		return nil, err
+	}
+	playlist.SeqNo = live.SeqNo - uint64(len(s.dvr))
+	playlist.DiscontinuitySeq = live.DiscontinuitySeq - discontinuities
+	playlist.TargetDuration = live.TargetDuration
+
+	for _, seg := range segments {
+		// Appending sets the sequence id of the segment, use a copy as the live playlists share them.
+		copied := *seg
+		err = playlist.AppendSegment(&copied)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return playlist, nil
+}
+
+// WriteDVRPlaylist writes the main playlist with the played parts of the DVR window.
+func (s *Stream) WriteDVRPlaylist(writer io.Writer) (int, error) {
+	return s.writeDVRPlaylist(writer, "")
+}
+
+// WriteRenditionDVRPlaylist writes the playlist of a rendition with the played parts of the DVR window, the main one included.
+func (s *Stream) WriteRenditionDVRPlaylist(writer io.Writer, name string) (int, error) {
+	return s.writeDVRPlaylist(writer, name)
+}
+
+// writeDVRPlaylist writes the DVR playlist of the named rendition, or of the main one if name is empty.
+func (s *Stream) writeDVRPlaylist(writer io.Writer, name string) (int, error) {
+	if s.options.DVRWindow == 0 {
+		return 0, ErrDVRDisabled
+	}
+
+	s.RLock()
+
+	var data []byte
+	err := ErrRenditionNotFound
+	for r, rendition := range s.renditions {
+		if name != "" && rendition.name != name {
+			continue
+		}
+
+		var playlist *m3u8.MediaPlaylist
+		playlist, err = s.dvrPlaylist(r)
+		if err == nil {
+			// The date ranges are updated with the stream locked.
+			data = playlist.Encode().Bytes()
+		}
+		break
+	}
+
+	// Unlock here to allow long writing.
+	s.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return writer.Write(data)
+}
@@ -0,0 +1,40 @@
+package musiko
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamSkippedPartsNotKept(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{WindowSize: 4, DVRWindow: time.Minute}, nil)
+	events := stream.Subscribe()
+	defer stream.Unsubscribe(events)
+
+	head := strings.Split(playlistParts(t, stream)[0].URI, "/")[0]
+	skip(t, stream)
+	waitEvent(t, events, TrackFinished)
+
+	buffer := new(bytes.Buffer)
+	_, err := stream.WriteDVRPlaylist(buffer)
+	if err != nil {
+		t.Fatalf("cannot write dvr playlist: %s", err)
+	}
+	if strings.Contains(buffer.String(), head+"/") {
+		t.Errorf("skipped parts kept for rewinding:\n%s", buffer.String())
+	}
+
+	// All the parts are released once the stream is over, the skipped ones included.
+	err = stream.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop: %s", err)
+	}
+	store := stream.Store.(*MemoryStore)
+	store.RLock()
+	defer store.RUnlock()
+	if len(store.data) != 0 || store.used != 0 {
+		t.Errorf("%d entries left in the store", len(store.data))
+	}
+}
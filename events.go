@@ -0,0 +1,182 @@
+package musiko
+
+import (
+	"time"
+)
+
+const (
+	eventsBuffer = 64 // Progress events kept for a slow subscriber before dropping the new ones.
+)
+
+type EventType int
+
+const (
+	TrackQueued EventType = iota
+	TrackStarted
+	TrackFinished
+	SegmentPublished
+	PartStarted
+	Paused
+	Resumed
+	FetchStarted
+	FetchFailed
+	Killed
+	Overflow
+)
+
+var eventNames = []string{
+	"track_queued",
+	"track_started",
+	"track_finished",
+	"segment_published",
+	"part_started",
+	"paused",
+	"resumed",
+	"fetch_started",
+	"fetch_failed",
+	"killed",
+	"overflow",
+}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[t]
+}
+
+// Event is something that happened to a stream. Track fields are only set for the track events, SegmentPublished and PartStarted.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	TrackId  string
+	Track    *TrackInfo
+	Index    int     // Index of the published or started part.
+	Duration float64 // Duration of the published or started part, in seconds.
+	Err      error   // Set for FetchFailed and Killed.
+	Dropped  int     // Set for Overflow, number of progress events dropped before it.
+}
+
+// subscriber queues the events of a subscription, delivered by its own goroutine so a slow subscriber never blocks the stream.
+type subscriber struct {
+	events  chan Event
+	pending []Event
+	dropped int
+	ready   chan struct{} // Signaled when events are pending.
+	quit    chan struct{} // Closed by Unsubscribe.
+	over    bool          // No event follows the pending ones.
+}
+
+// progress returns true for the events sent for every part, which may be dropped.
+func (t EventType) progress() bool {
+	return t == SegmentPublished || t == PartStarted
+}
+
+// push queues an event, dropping the progress ones if eventsBuffer events are already pending.
+// Dropped events are reported by an Overflow event, queued once there is room again.
+func (sub *subscriber) push(event Event) {
+	if event.Type.progress() && len(sub.pending) >= eventsBuffer {
+		sub.dropped++
+		return
+	}
+
+	if sub.dropped > 0 {
+		sub.pending = append(sub.pending, Event{Type: Overflow, Time: event.Time, Dropped: sub.dropped})
+		sub.dropped = 0
+	}
+	sub.pending = append(sub.pending, event)
+
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe returns a channel receiving the events of the stream, closed after the Killed event.
+// Events are queued so a slow subscriber never blocks the stream, only SegmentPublished and PartStarted may be dropped.
+func (s *Stream) Subscribe() <-chan Event {
+	sub := &subscriber{
+		events: make(chan Event),
+		ready:  make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+
+	if s.subscribers == nil {
+		// The stream is over.
+		close(sub.events)
+		return sub.events
+	}
+	s.subscribers[sub.events] = sub
+
+	go s.deliver(sub)
+	return sub.events
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe, which is then closed.
+func (s *Stream) Unsubscribe(events <-chan Event) {
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+
+	if sub, exists := s.subscribers[events]; exists {
+		delete(s.subscribers, events)
+		close(sub.quit)
+	}
+}
+
+// deliver sends the queued events to the subscriber, until it unsubscribes or the stream is over.
+func (s *Stream) deliver(sub *subscriber) {
+	defer close(sub.events)
+
+	for {
+		s.subscribersLock.Lock()
+		pending, over := sub.pending, sub.over
+		sub.pending = nil
+		s.subscribersLock.Unlock()
+
+		for _, event := range pending {
+			select {
+			case sub.events <- event:
+			case <-sub.quit:
+				return
+			}
+		}
+
+		if over {
+			return
+		}
+
+		select {
+		case <-sub.ready:
+		case <-sub.quit:
+			return
+		}
+	}
+}
+
+// emit queues an event for the subscribers. May be called with the stream locked.
+func (s *Stream) emit(event Event) {
+	event.Time = time.Now()
+
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+
+	for _, sub := range s.subscribers {
+		sub.push(event)
+	}
+
+	// Nothing happens after the end of the stream.
+	if event.Type == Killed {
+		for _, sub := range s.subscribers {
+			sub.over = true
+		}
+		s.subscribers = nil
+	}
+}
+
+func trackEvent(t EventType, track *Track) Event {
+	info := track.info
+	return Event{Type: t, TrackId: track.id.String(), Track: &info}
+}
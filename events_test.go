@@ -0,0 +1,121 @@
+package musiko
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventsSlowSubscriber(t *testing.T) {
+	stream, err := NewStream(nil, "", StreamOptions{})
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	events := stream.Subscribe()
+
+	// Nothing is read while the stream emits.
+	const published = 10 * eventsBuffer
+	stream.emit(Event{Type: TrackQueued})
+	for i := 0; i < published; i++ {
+		stream.emit(Event{Type: SegmentPublished, Index: i})
+		if i%eventsBuffer == 0 {
+			stream.emit(Event{Type: TrackStarted, Index: i})
+		}
+	}
+	stream.emit(Event{Type: Killed})
+
+	var received, dropped, started int
+	timeout := time.After(testTimeout)
+	for done := false; !done; {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			switch event.Type {
+			case SegmentPublished:
+				received++
+			case Overflow:
+				dropped += event.Dropped
+			case TrackStarted:
+				started++
+			}
+		case <-timeout:
+			t.Fatalf("events channel not closed")
+		}
+	}
+
+	if started != published/eventsBuffer {
+		t.Errorf("got %d track started events, expected %d", started, published/eventsBuffer)
+	}
+	if dropped == 0 || received+dropped != published {
+		t.Errorf("got %d segment events and %d dropped, expected %d", received, dropped, published)
+	}
+}
+
+func TestEventsUnsubscribe(t *testing.T) {
+	stream, err := NewStream(nil, "", StreamOptions{})
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	events := stream.Subscribe()
+	stream.emit(Event{Type: TrackQueued})
+
+	stream.Unsubscribe(events)
+	stream.emit(Event{Type: TrackStarted})
+
+	// The unread events may be dropped, the channel is closed.
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == TrackStarted {
+				t.Fatalf("event received after unsubscribing")
+			}
+		case <-timeout:
+			t.Fatalf("events channel not closed")
+		}
+	}
+}
+
+func TestStreamPause(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{}, nil)
+	events := stream.Subscribe()
+	defer stream.Unsubscribe(events)
+
+	err := stream.Pause()
+	if err != nil {
+		t.Fatalf("cannot pause: %s", err)
+	}
+	waitEvent(t, events, Paused)
+
+	if err := stream.Pause(); err != ErrStreamNotRunning {
+		t.Errorf("paused twice: %v", err)
+	}
+
+	err = stream.Resume()
+	if err != nil {
+		t.Fatalf("cannot resume: %s", err)
+	}
+	// The second pause emitted nothing.
+	timeout := time.After(testTimeout)
+	for resumed := false; !resumed; {
+		select {
+		case event := <-events:
+			if event.Type == Paused {
+				t.Fatalf("paused event emitted twice")
+			}
+			resumed = event.Type == Resumed
+		case <-timeout:
+			t.Fatalf("no %s event", Resumed)
+		}
+	}
+
+	if err := stream.Resume(); err != ErrStreamNotPaused {
+		t.Errorf("resumed twice: %v", err)
+	}
+}
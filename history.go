@@ -0,0 +1,301 @@
+package musiko
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	historySaveDelay = time.Second // Changes made within the delay are saved together.
+)
+
+var (
+	ErrInvalidHistory = errors.New("invalid history size")
+	ErrTrackNotCached = errors.New("track audio not cached anymore")
+)
+
+// HistoryEntry is a played track. Cached is true while its audio can still be downloaded.
+type HistoryEntry struct {
+	Id       string    `json:"id"`
+	Station  string    `json:"station"`
+	Info     TrackInfo `json:"info"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended"`
+	Skipped  bool      `json:"skipped"`
+	Feedback *bool     `json:"feedback,omitempty"` // Nil if no feedback was sent.
+	Cached   bool      `json:"cached"`
+	File     TrackFile `json:"file"`
+
+	token string // Kept for feedback once the audio is released.
+	track *Track
+	store PartStore
+}
+
+// historyRecord is an entry as saved to the file, with its feedback token that is not served.
+type historyRecord struct {
+	*HistoryEntry
+	Token string `json:"token,omitempty"`
+}
+
+// NewHistory creates a history of the last size played tracks, keeping the audio of the last cache ones.
+// If path is not empty, the history is loaded from and saved to this file in the background, without the audio.
+func NewHistory(size int, cache int, path string) (*History, error) {
+	if size < 1 || cache < 0 {
+		return nil, ErrInvalidHistory
+	}
+	if cache > size {
+		cache = size
+	}
+
+	h := new(History)
+	h.size = size
+	h.cache = cache
+	h.path = path
+	h.entries = make([]*HistoryEntry, 0)
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			var records []historyRecord
+			err = json.Unmarshal(data, &records)
+			if err != nil {
+				return nil, err
+			}
+			for _, record := range records {
+				if record.HistoryEntry == nil {
+					continue
+				}
+				record.token = record.Token
+				h.entries = append(h.entries, record.HistoryEntry)
+			}
+			if len(h.entries) > size {
+				h.entries = h.entries[len(h.entries)-size:]
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// History keeps the tracks played by one or more streams, oldest first.
+type History struct {
+	size    int
+	cache   int
+	path    string
+	entries []*HistoryEntry
+
+	scheduled bool       // A save is pending.
+	saveLock  sync.Mutex // Keeps the snapshots written in order.
+	sync.RWMutex
+}
+
+// add records a track that finished playing, taking over its data in the store.
+func (h *History) add(station string, track *Track, store PartStore) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.entries = append(h.entries, &HistoryEntry{
+		Id:       track.id.String(),
+		Station:  station,
+		Info:     track.info,
+		Started:  track.started,
+		Ended:    time.Now(),
+		Skipped:  track.skipped,
+		Feedback: track.feedback,
+		File:     track.file(),
+		token:    track.token,
+		track:    track,
+		store:    store,
+	})
+
+	if len(h.entries) > h.size {
+		h.release(h.entries[0])
+		h.entries = h.entries[1:]
+	}
+	if len(h.entries) > h.cache {
+		h.release(h.entries[len(h.entries)-h.cache-1])
+	}
+
+	h.scheduleSave()
+}
+
+// release removes the audio of an entry from the store.
+func (h *History) release(entry *HistoryEntry) {
+	if entry.track == nil {
+		return
+	}
+
+	// Local tracks are read from disk.
+	if entry.track.path == "" {
+		err := entry.store.Remove(entry.Id)
+		if err != nil && err != ErrDataNotFound {
+			log.Printf("Cannot remove data from store: %s (%s).\n", err.Error(), entry.Id)
+		}
+	}
+
+	entry.track = nil
+	entry.store = nil
+}
+
+// scheduleSave saves the history after historySaveDelay, if not already scheduled. Must be called with the history locked.
+func (h *History) scheduleSave() {
+	if h.path == "" || h.scheduled {
+		return
+	}
+	h.scheduled = true
+
+	time.AfterFunc(historySaveDelay, func() {
+		err := h.Save()
+		if err != nil {
+			log.Printf("Cannot save history: %s.\n", err.Error())
+		}
+	})
+}
+
+// Save writes the history to its file now, if it has one. Changes are otherwise saved in the background.
+func (h *History) Save() error {
+	if h.path == "" {
+		return nil
+	}
+
+	h.saveLock.Lock()
+	defer h.saveLock.Unlock()
+
+	// Only copy the entries with the history locked, the file may be slow to write.
+	h.Lock()
+	h.scheduled = false
+	records := make([]historyRecord, len(h.entries))
+	for i, entry := range h.entries {
+		records[i] = historyRecord{entry, entry.token}
+	}
+	data, err := json.Marshal(records)
+	h.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial history.
+	tmp := h.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.path)
+}
+
+// Entries returns up to limit entries, newest first, skipping the offset newest ones, and the total number of entries.
+func (h *History) Entries(offset, limit int) ([]HistoryEntry, int) {
+	h.RLock()
+	defer h.RUnlock()
+
+	total := len(h.entries)
+	entries := make([]HistoryEntry, 0)
+
+	for i := total - 1 - offset; i >= 0 && len(entries) < limit; i-- {
+		entry := *h.entries[i]
+		entry.Cached = entry.track != nil
+		entries = append(entries, entry)
+	}
+
+	return entries, total
+}
+
+// Entry returns the entry of a track, if still in the history.
+func (h *History) Entry(trackId string) (*HistoryEntry, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, entry := range h.entries {
+		if entry.Id == trackId {
+			found := *entry
+			found.Cached = entry.track != nil
+			return &found, nil
+		}
+	}
+
+	return nil, ErrTrackNotFound
+}
+
+// feedbackTrack returns a played track to give feedback to, without its audio.
+func (h *History) feedbackTrack(trackId string) (*Track, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, entry := range h.entries {
+		if entry.Id == trackId {
+			track := new(Track)
+			track.info = entry.Info
+			track.token = entry.token
+			return track, nil
+		}
+	}
+
+	return nil, ErrTrackNotFound
+}
+
+// setFeedback records the feedback given to a played track.
+func (h *History) setFeedback(trackId string, positive bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, entry := range h.entries {
+		if entry.Id != trackId {
+			continue
+		}
+
+		entry.Feedback = &positive
+		h.scheduleSave()
+		return
+	}
+}
+
+// WriteTrack writes the audio of a played track, if still cached.
+func (h *History) WriteTrack(writer io.Writer, trackId string) (int, error) {
+	h.RLock()
+	var (
+		track *Track
+		store PartStore
+	)
+	for _, entry := range h.entries {
+		if entry.Id == trackId {
+			track, store = entry.track, entry.store
+			break
+		}
+	}
+	h.RUnlock()
+
+	if track == nil {
+		return 0, ErrTrackNotCached
+	}
+
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	if track.path != "" {
+		r, err = track.Open()
+	} else {
+		r, err = store.Open(trackId)
+	}
+	if err == ErrDataNotFound {
+		return 0, ErrTrackNotCached
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(writer, r)
+	return int(n), err
+}
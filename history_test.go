@@ -0,0 +1,61 @@
+package musiko
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistorySave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	history, err := NewHistory(2, 1, path)
+	if err != nil {
+		t.Fatalf("cannot create history: %s", err)
+	}
+
+	store := NewMemoryStore(0)
+	ids := make([]string, 3)
+	for i := range ids {
+		track := NewTrack("", TrackInfo{Name: "track"}, nil)
+		ids[i] = track.id.String()
+		history.add("Station", track, store)
+	}
+	history.setFeedback(ids[2], true)
+
+	// The changes are saved together in the background.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	loaded, err := NewHistory(2, 1, path)
+	if err != nil {
+		t.Fatalf("cannot load history: %s", err)
+	}
+	entries, total := loaded.Entries(0, 10)
+	if total != 2 || entries[0].Id != ids[2] || entries[1].Id != ids[1] {
+		t.Fatalf("got %d entries %+v, expected the last 2 tracks", total, entries)
+	}
+	if entries[0].Station != "Station" || entries[0].Feedback == nil || !*entries[0].Feedback || entries[0].Cached {
+		t.Errorf("got entry %+v", entries[0])
+	}
+}
+
+func TestHistorySaveWithoutPath(t *testing.T) {
+	history, err := NewHistory(1, 0, "")
+	if err != nil {
+		t.Fatalf("cannot create history: %s", err)
+	}
+	history.add("Station", NewTrack("", TrackInfo{}, nil), NewMemoryStore(0))
+
+	if err := history.Save(); err != nil {
+		t.Errorf("got %v, expected nothing to save", err)
+	}
+}
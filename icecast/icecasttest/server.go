@@ -0,0 +1,213 @@
+// Package icecasttest provides an in-process stand-in of an Icecast server, receiving the audio and the titles of sources.
+package icecasttest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	sourceUser    = "source"
+	adminMetadata = "/admin/metadata"
+)
+
+// Server accepts sources on any mount with its password, over PUT or the legacy SOURCE method.
+type Server struct {
+	URL      string // Base URL of the server, without credentials.
+	password string
+
+	listener net.Listener
+	mounts   map[string]*Mount
+	conns    map[net.Conn]struct{}
+	closed   bool
+	routines sync.WaitGroup
+	sync.Mutex
+}
+
+// Mount is what a mount received from its sources.
+type Mount struct {
+	Connected   bool
+	Sources     int // Number of accepted connections.
+	Method      string
+	ContentType string
+	Name        string
+	Data        []byte
+	Titles      []string
+}
+
+func NewServer(password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Server)
+	s.URL = "http://" + listener.Addr().String()
+	s.password = password
+	s.listener = listener
+	s.mounts = make(map[string]*Mount)
+	s.conns = make(map[net.Conn]struct{})
+
+	s.routines.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// MountURL returns the URL of a mount with the credentials of the sources, as used by icecast.NewSource.
+func (s *Server) MountURL(mount string) string {
+	return fmt.Sprintf("http://%s:%s@%s%s", sourceUser, s.password, s.listener.Addr().String(), mount)
+}
+
+// Mount returns a copy of what a mount received, and whether a source ever connected to it.
+func (s *Server) Mount(path string) (Mount, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	mount, exists := s.mounts[path]
+	if !exists {
+		return Mount{}, false
+	}
+
+	copied := *mount
+	copied.Data = append([]byte{}, mount.Data...)
+	copied.Titles = append([]string{}, mount.Titles...)
+	return copied, true
+}
+
+// Close stops accepting sources and disconnects the connected ones.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+
+	s.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.Unlock()
+
+	s.routines.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.routines.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.Unlock()
+
+		s.routines.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.routines.Done()
+	defer func() {
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok || user != sourceUser || password != s.password {
+		respond(conn, http.StatusUnauthorized, "")
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPut || req.Method == "SOURCE":
+		s.receive(conn, reader, req)
+	case req.Method == http.MethodGet && req.URL.Path == adminMetadata:
+		s.updateMetadata(conn, req)
+	default:
+		respond(conn, http.StatusNotFound, "")
+	}
+}
+
+// receive records the audio of a source until it disconnects.
+func (s *Server) receive(conn net.Conn, reader *bufio.Reader, req *http.Request) {
+	s.Lock()
+	mount, exists := s.mounts[req.URL.Path]
+	if !exists {
+		mount = new(Mount)
+		s.mounts[req.URL.Path] = mount
+	}
+	if mount.Connected {
+		s.Unlock()
+		respond(conn, http.StatusForbidden, "")
+		return
+	}
+	mount.Connected = true
+	mount.Sources++
+	mount.Method = req.Method
+	mount.ContentType = req.Header.Get("Content-Type")
+	mount.Name = req.Header.Get("Ice-Name")
+	s.Unlock()
+
+	respond(conn, http.StatusOK, "")
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buffer)
+
+		s.Lock()
+		mount.Data = append(mount.Data, buffer[:n]...)
+		if err != nil {
+			mount.Connected = false
+		}
+		s.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// updateMetadata records the title of a connected mount.
+func (s *Server) updateMetadata(conn net.Conn, req *http.Request) {
+	query := req.URL.Query()
+
+	s.Lock()
+	mount, exists := s.mounts[query.Get("mount")]
+	if !exists || !mount.Connected || query.Get("mode") != "updinfo" {
+		s.Unlock()
+		respond(conn, http.StatusBadRequest, "")
+		return
+	}
+	mount.Titles = append(mount.Titles, query.Get("song"))
+	s.Unlock()
+
+	respond(conn, http.StatusOK, "<?xml version=\"1.0\"?>\n<iceresponse><message>Metadata update successful</message><return>1</return></iceresponse>\n")
+}
+
+// respond writes the response of a request, the sources receiving no body nor length.
+func respond(conn net.Conn, status int, body string) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if body != "" {
+		_, _ = fmt.Fprintf(conn, "Connection: close\r\nContent-Type: text/xml\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		return
+	}
+	_, _ = fmt.Fprint(conn, "\r\n")
+}
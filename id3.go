@@ -0,0 +1,300 @@
+package musiko
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+)
+
+const (
+	tsMetadataPID    = 0x0102
+	tsStreamMetadata = 0x15
+	pesPrivateStream = 0xBD
+)
+
+var (
+	ErrInvalidTS = errors.New("invalid or unsupported MPEG-TS data")
+)
+
+// id3Format identifies ID3 metadata in the descriptors, both as application format and metadata format.
+var id3Format = []byte{0xFF, 0xFF, 'I', 'D', '3', ' ', 0xFF, 'I', 'D', '3', ' ', 0x00}
+
+// id3Tag builds an ID3v2.4 tag with the info of the track. The cover is linked by URL, as allowed by the APIC frame.
+func id3Tag(info TrackInfo) []byte {
+	frames := new(bytes.Buffer)
+
+	for _, text := range []struct {
+		id    string
+		value string
+	}{
+		{"TPE1", info.Artist},
+		{"TALB", info.Album},
+		{"TIT2", info.Name},
+	} {
+		if text.value != "" {
+			// UTF-8 encoding.
+			writeID3Frame(frames, text.id, append([]byte{0x03}, text.value...))
+		}
+	}
+
+	if info.Cover != "" {
+		// UTF-8 encoding, "-->" MIME type for links, front cover and empty description.
+		frame := append([]byte{0x03}, "-->"...)
+		frame = append(frame, 0x00, 0x03, 0x00)
+		writeID3Frame(frames, "APIC", append(frame, info.Cover...))
+	}
+
+	tag := new(bytes.Buffer)
+	tag.WriteString("ID3")
+	tag.Write([]byte{0x04, 0x00, 0x00})
+	tag.Write(syncsafe(frames.Len()))
+	tag.Write(frames.Bytes())
+
+	return tag.Bytes()
+}
+
+func writeID3Frame(buffer *bytes.Buffer, id string, data []byte) {
+	buffer.WriteString(id)
+	buffer.Write(syncsafe(len(data)))
+	buffer.Write([]byte{0x00, 0x00})
+	buffer.Write(data)
+}
+
+// syncsafe encodes a size on 4 bytes of 7 bits.
+func syncsafe(size int) []byte {
+	return []byte{byte(size>>21) & 0x7F, byte(size>>14) & 0x7F, byte(size>>7) & 0x7F, byte(size) & 0x7F}
+}
+
+// trackTitle returns the title of the first segment of a track in the playlists.
+func trackTitle(info TrackInfo) string {
+	title := info.Name
+	if info.Artist != "" {
+		title = info.Artist + " - " + info.Name
+	}
+
+	// The title ends the EXTINF line.
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(title)
+}
+
+// tagPart adds the info of the track as timed metadata to the first part of a track, keeping the part untouched on failure.
+// The other parts only declare the metadata stream, since players expect the program to stay the same.
+// Timed metadata in MPEG-TS needs no playlist tag, players find it in the PMT.
+func tagPart(track *Track, data []byte, index int) []byte {
+	var tag []byte
+	if index == 0 {
+		tag = id3Tag(track.info)
+	}
+
+	tagged, err := injectTimedMetadata(data, tag)
+	if err != nil {
+		log.Printf("Cannot add timed metadata: %s (%s).\n", err.Error(), track.id.String())
+		return data
+	}
+
+	return tagged
+}
+
+// injectTimedMetadata adds an ID3 metadata stream to the program of a TS part, if not declared yet, and a PES packet carrying tag
+// at the time of the first audio frame if tag is not nil. Works with the parts of the native muxer and the ones of ffmpeg.
+func injectTimedMetadata(data []byte, tag []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%tsPacketSize != 0 {
+		return nil, ErrInvalidTS
+	}
+
+	var (
+		pmtPID   = -1
+		audioPID = -1
+		pts      uint64
+		found    bool
+		pmt      []byte
+		declared bool
+	)
+
+	// Find the program, its audio stream, and the first timestamp.
+	for offset := 0; offset < len(data) && !found; offset += tsPacketSize {
+		packet := data[offset : offset+tsPacketSize]
+		pid, start, payload := tsPayload(packet)
+		if !start || payload == nil {
+			continue
+		}
+
+		switch {
+		case pid == tsPATPID && pmtPID < 0:
+			section, err := psiPayload(payload)
+			if err != nil || len(section) < 12 {
+				return nil, ErrInvalidTS
+			}
+			pmtPID = int(section[10]&0x1F)<<8 | int(section[11])
+		case pid == pmtPID && pmt == nil:
+			section, err := psiPayload(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			pmt, audioPID, declared, err = withMetadataStream(section)
+			if err != nil {
+				return nil, err
+			}
+		case pid == audioPID:
+			if len(payload) < 14 || !bytes.HasPrefix(payload, []byte{0x00, 0x00, 0x01}) || payload[7]&0x80 == 0 {
+				return nil, ErrInvalidTS
+			}
+			pts = decodePTS(payload[9:14])
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrInvalidTS
+	}
+	if declared && tag == nil {
+		return data, nil
+	}
+
+	muxer := newTSMuxer(aacConfig{})
+	metadata := new(bytes.Buffer)
+	if tag != nil {
+		muxer.writePackets(metadata, tsMetadataPID, pesPacket(pesPrivateStream, 0x84, pts, tag), nil)
+	}
+
+	// Replace the PMTs and insert the metadata after the first one.
+	output := bytes.NewBuffer(make([]byte, 0, len(data)+metadata.Len()))
+	inserted := false
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		packet := data[offset : offset+tsPacketSize]
+		pid, start, _ := tsPayload(packet)
+		if pid != pmtPID || !start {
+			output.Write(packet)
+			continue
+		}
+
+		muxer.continuity[uint16(pmtPID)] = packet[3] & 0x0F
+		muxer.writeSection(output, uint16(pmtPID), pmt)
+
+		if !inserted {
+			output.Write(metadata.Bytes())
+			inserted = true
+		}
+	}
+
+	return output.Bytes(), nil
+}
+
+// tsPayload returns the PID of a TS packet, whether it starts a payload, and the payload.
+func tsPayload(packet []byte) (int, bool, []byte) {
+	if packet[0] != 0x47 {
+		return -1, false, nil
+	}
+
+	pid := int(packet[1]&0x1F)<<8 | int(packet[2])
+	start := packet[1]&0x40 != 0
+	control := packet[3] >> 4 & 0x03
+
+	offset := 4
+	if control&0x02 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if control&0x01 == 0 || offset >= tsPacketSize {
+		return pid, start, nil
+	}
+
+	return pid, start, packet[offset:]
+}
+
+// psiPayload returns the section following the pointer field of a PSI payload, if it ends in the packet.
+func psiPayload(payload []byte) ([]byte, error) {
+	offset := 1 + int(payload[0])
+	if offset+3 > len(payload) {
+		return nil, ErrInvalidTS
+	}
+
+	section := payload[offset:]
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+length > len(section) || length < 13 {
+		return nil, ErrInvalidTS
+	}
+
+	return section[:3+length], nil
+}
+
+// withMetadataStream returns the PMT section with an ID3 metadata stream added, the PID of the first audio stream,
+// and whether the stream was already declared, in which case the section is returned as is.
+func withMetadataStream(section []byte) ([]byte, int, bool, error) {
+	infoLength := int(section[10]&0x0F)<<8 | int(section[11])
+	if 12+infoLength > len(section)-4 {
+		return nil, -1, false, ErrInvalidTS
+	}
+
+	programInfo := section[12 : 12+infoLength]
+	streams := section[12+infoLength : len(section)-4]
+
+	audioPID := -1
+	declared := false
+	for i := 0; i+5 <= len(streams); {
+		pid := int(streams[i+1]&0x1F)<<8 | int(streams[i+2])
+		if pid == tsMetadataPID {
+			if streams[i] != tsStreamMetadata {
+				return nil, -1, false, ErrInvalidTS
+			}
+			declared = true
+		} else if audioPID < 0 && streams[i] != tsStreamMetadata {
+			audioPID = pid
+		}
+		i += 5 + (int(streams[i+3]&0x0F)<<8 | int(streams[i+4]))
+	}
+	if audioPID < 0 {
+		return nil, -1, false, ErrInvalidTS
+	}
+	if declared {
+		return section, audioPID, true, nil
+	}
+
+	pointer, metadata := metadataStream()
+	programInfo = append(append([]byte{}, programInfo...), pointer...)
+	streams = append(append([]byte{}, streams...), metadata...)
+
+	data := []byte{
+		section[8], section[9], // PCR PID.
+		0xF0 | byte(len(programInfo)>>8), byte(len(programInfo)),
+	}
+	data = append(data, programInfo...)
+	data = append(data, streams...)
+
+	id := uint16(section[3])<<8 | uint16(section[4])
+	pmt := psiSection(0x02, id, data)
+	pmt[5] = section[5] // Keep the version.
+
+	// The CRC covers the version.
+	crc := crc32MPEG(pmt[:len(pmt)-4])
+	pmt = append(pmt[:len(pmt)-4], byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	if len(pmt)+5 > tsPacketSize {
+		return nil, -1, false, ErrInvalidTS
+	}
+
+	return pmt, audioPID, false, nil
+}
+
+// metadataStream returns the metadata pointer descriptor of the program info, and the PMT entry of the ID3 metadata stream.
+func metadataStream() ([]byte, []byte) {
+	// Metadata pointer descriptor: no locator, no carriage flags, program 1.
+	pointer := append([]byte{0x25, byte(len(id3Format) + 3)}, id3Format...)
+	pointer = append(pointer, 0x1F, 0x00, 0x01)
+
+	// Metadata descriptor: no decoder config.
+	descriptor := append([]byte{0x26, byte(len(id3Format) + 1)}, id3Format...)
+	descriptor = append(descriptor, 0x0F)
+	metadata := []byte{
+		tsStreamMetadata,
+		0xE0 | byte(tsMetadataPID>>8), byte(tsMetadataPID & 0xFF),
+		0xF0 | byte(len(descriptor)>>8), byte(len(descriptor)),
+	}
+
+	return pointer, append(metadata, descriptor...)
+}
+
+func decodePTS(data []byte) uint64 {
+	return uint64(data[0]>>1&0x07)<<30 |
+		uint64(data[1])<<22 | uint64(data[2]>>1)<<15 |
+		uint64(data[3])<<7 | uint64(data[4]>>1)
+}
@@ -0,0 +1,88 @@
+package musiko
+
+import (
+	"bytes"
+	"github.com/scotow/musiko/pandoratest"
+	"testing"
+	"time"
+)
+
+// tsSections returns the PMT sections of a TS part, and the number of packets of the metadata stream.
+func tsSections(t *testing.T, data []byte) ([][]byte, int) {
+	t.Helper()
+
+	var (
+		pmts     [][]byte
+		metadata int
+	)
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		pid, start, payload := tsPayload(data[offset : offset+tsPacketSize])
+		switch {
+		case pid == tsPMTPID && start:
+			section, err := psiPayload(payload)
+			if err != nil {
+				t.Fatalf("invalid pmt: %s", err)
+			}
+			pmts = append(pmts, section)
+		case pid == tsMetadataPID:
+			metadata++
+		}
+	}
+	return pmts, metadata
+}
+
+func TestTagPart(t *testing.T) {
+	_, parts, err := NativeSplitTS(pandoratest.SilentM4A(25*time.Second), defaultSegmentTime)
+	if err != nil {
+		t.Fatalf("cannot split: %s", err)
+	}
+	track := NewTrack("", TrackInfo{Artist: "Artist", Name: "Song"}, nil)
+
+	for i, part := range parts {
+		data := tagPart(track, part.data, i)
+
+		pmts, metadata := tsSections(t, data)
+		if len(pmts) == 0 {
+			t.Fatalf("part %d has no pmt", i)
+		}
+		// All the parts declare the same program.
+		for _, pmt := range pmts {
+			if !bytes.Equal(pmt, pmtSection()) {
+				t.Errorf("part %d has pmt %x, expected %x", i, pmt, pmtSection())
+			}
+		}
+
+		if i == 0 && metadata == 0 {
+			t.Errorf("first part has no tag")
+		}
+		if i > 0 && (metadata != 0 || !bytes.Equal(data, part.data)) {
+			t.Errorf("part %d modified", i)
+		}
+	}
+}
+
+func TestWithMetadataStream(t *testing.T) {
+	// PMT of ffmpeg, version 3, without the metadata stream.
+	section := psiSection(0x02, 0x0001, []byte{
+		0xE1, 0x00,
+		0xF0, 0x00,
+		tsStreamADTS, 0xE1, 0x00, 0xF0, 0x00,
+	})
+	section[5] = 0xC7
+	crc := crc32MPEG(section[:len(section)-4])
+	section = append(section[:len(section)-4], byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	pmt, audioPID, declared, err := withMetadataStream(section)
+	if err != nil || declared || audioPID != 0x100 {
+		t.Fatalf("got pid %x, declared %t, error %v", audioPID, declared, err)
+	}
+	if pmt[5] != 0xC7 || crc32MPEG(pmt) != 0 {
+		t.Errorf("version not kept or invalid crc: %x", pmt)
+	}
+
+	// Adding the stream again changes nothing.
+	again, audioPID, declared, err := withMetadataStream(pmt)
+	if err != nil || !declared || audioPID != 0x100 || !bytes.Equal(again, pmt) {
+		t.Errorf("got pid %x, declared %t, error %v", audioPID, declared, err)
+	}
+}
@@ -0,0 +1,185 @@
+package musiko
+
+import (
+	"github.com/dhowden/tag"
+	"github.com/pkg/errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localBatchSize    = 10
+	localRepeatWindow = 50 // Number of recently played files that cannot be picked again.
+)
+
+var (
+	ErrNoLocalFiles = errors.New("no audio files found in directory")
+)
+
+var (
+	localExtensions = map[string]bool{
+		".mp3":  true,
+		".m4a":  true,
+		".flac": true,
+		".ogg":  true,
+	}
+)
+
+// LocalSource is a TrackSource that shuffles the audio files of a local directory tree.
+type LocalSource struct {
+	root     string
+	files    []string
+	modTimes map[string]time.Time
+	recent   []string
+	random   *rand.Rand
+	sync.Mutex
+}
+
+func NewLocalSource(root string) (*LocalSource, error) {
+	source := new(LocalSource)
+	source.root = root
+	source.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	_, err := source.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(source.files) == 0 {
+		return nil, ErrNoLocalFiles
+	}
+
+	return source, nil
+}
+
+// scan walks the directory tree and replaces the files list if anything was added, removed or modified.
+func (l *LocalSource) scan() (bool, error) {
+	modTimes := make(map[string]time.Time)
+
+	err := filepath.Walk(l.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !localExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		modTimes[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	changed := len(modTimes) != len(l.modTimes)
+	if !changed {
+		for path, modTime := range modTimes {
+			if previous, exists := l.modTimes[path]; !exists || !previous.Equal(modTime) {
+				changed = true
+				break
+			}
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	files := make([]string, 0, len(modTimes))
+	for path := range modTimes {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+
+	l.files = files
+	l.modTimes = modTimes
+
+	return true, nil
+}
+
+// pick returns a random file that isn't part of the recently played ones.
+func (l *LocalSource) pick() string {
+	window := localRepeatWindow
+	if window >= len(l.files) {
+		window = len(l.files) - 1
+	}
+	if len(l.recent) > window {
+		l.recent = l.recent[len(l.recent)-window:]
+	}
+
+	played := make(map[string]bool, len(l.recent))
+	for _, path := range l.recent {
+		played[path] = true
+	}
+
+	candidates := make([]string, 0, len(l.files)-len(played))
+	for _, path := range l.files {
+		if !played[path] {
+			candidates = append(candidates, path)
+		}
+	}
+
+	path := candidates[l.random.Intn(len(candidates))]
+	l.recent = append(l.recent, path)
+
+	return path
+}
+
+// NextTracks implements TrackSource. The station and the HTTP client are not used.
+func (l *LocalSource) NextTracks(_ string, _ *http.Client) ([]*Track, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	changed, err := l.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		log.Printf("Local directory scanned: %d files (%s).\n", len(l.files), l.root)
+	}
+
+	if len(l.files) == 0 {
+		return nil, ErrNoTracksFound
+	}
+
+	tracks := make([]*Track, localBatchSize)
+	for i := range tracks {
+		path := l.pick()
+		tracks[i] = NewLocalTrack(path, localTrackInfo(path))
+	}
+
+	return tracks, nil
+}
+
+// localTrackInfo reads the file's tags, falling back to the file name if they are missing.
+func localTrackInfo(path string) TrackInfo {
+	info := TrackInfo{Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return info
+	}
+	defer file.Close()
+
+	metadata, err := tag.ReadFrom(file)
+	if err != nil {
+		return info
+	}
+
+	if metadata.Title() != "" {
+		info.Name = metadata.Title()
+	}
+	info.Artist = metadata.Artist()
+	info.Album = metadata.Album()
+
+	return info
+}
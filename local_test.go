@@ -0,0 +1,178 @@
+package musiko
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestLibrary creates a directory tree with the given files, which contain no tags.
+func newTestLibrary(t *testing.T, files ...string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for _, file := range files {
+		addTestFile(t, root, file)
+	}
+
+	return root
+}
+
+func addTestFile(t *testing.T, root string, file string) {
+	t.Helper()
+
+	path := filepath.Join(root, file)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte("not audio"), 0600)
+	}
+	if err != nil {
+		t.Fatalf("cannot create %s: %s", file, err)
+	}
+}
+
+func TestNewLocalSource(t *testing.T) {
+	root := newTestLibrary(t, "a.mp3", "b/c.FLAC", "b/d/e.ogg", "f.m4a", "notes.txt", "cover.jpg")
+
+	source, err := NewLocalSource(root)
+	if err != nil {
+		t.Fatalf("cannot create source: %s", err)
+	}
+
+	expected := []string{"a.mp3", "b/c.FLAC", "b/d/e.ogg", "f.m4a"}
+	if len(source.files) != len(expected) {
+		t.Fatalf("got files %v, expected %v", source.files, expected)
+	}
+	for i, file := range expected {
+		if source.files[i] != filepath.Join(root, file) {
+			t.Errorf("got files %v, expected %v", source.files, expected)
+			break
+		}
+	}
+
+	_, err = NewLocalSource(newTestLibrary(t, "notes.txt"))
+	if err != ErrNoLocalFiles {
+		t.Errorf("got error %v, expected %v", err, ErrNoLocalFiles)
+	}
+}
+
+func TestLocalSourceNextTracks(t *testing.T) {
+	root := newTestLibrary(t, "Artist/First Song.mp3", "Artist/Second Song.flac")
+
+	source, err := NewLocalSource(root)
+	if err != nil {
+		t.Fatalf("cannot create source: %s", err)
+	}
+
+	tracks, err := source.NextTracks("", nil)
+	if err != nil {
+		t.Fatalf("cannot get tracks: %s", err)
+	}
+	if len(tracks) != localBatchSize {
+		t.Fatalf("got %d tracks, expected %d", len(tracks), localBatchSize)
+	}
+
+	for i, track := range tracks {
+		// Files without tags are named after the file.
+		name := strings.TrimSuffix(filepath.Base(track.path), filepath.Ext(track.path))
+		if track.info.Name != name || track.info.Artist != "" {
+			t.Errorf("got info %+v for %s", track.info, track.path)
+		}
+		// With two files, the previous one cannot be picked again.
+		if i > 0 && track.path == tracks[i-1].path {
+			t.Errorf("%s picked twice in a row", track.path)
+		}
+	}
+
+	file := tracks[0].file()
+	if !strings.HasSuffix(tracks[0].path, file.Extension) || file.ContentType == "" {
+		t.Errorf("got file %+v for %s", file, tracks[0].path)
+	}
+}
+
+func TestLocalSourceRepeatWindow(t *testing.T) {
+	files := make([]string, localRepeatWindow+10)
+	for i := range files {
+		files[i] = fmt.Sprintf("%02d.mp3", i)
+	}
+	source, err := NewLocalSource(newTestLibrary(t, files...))
+	if err != nil {
+		t.Fatalf("cannot create source: %s", err)
+	}
+
+	var picked []string
+	for len(picked) < 5*len(files) {
+		tracks, err := source.NextTracks("", nil)
+		if err != nil {
+			t.Fatalf("cannot get tracks: %s", err)
+		}
+		for _, track := range tracks {
+			picked = append(picked, track.path)
+		}
+	}
+
+	for i, path := range picked {
+		start := i - localRepeatWindow
+		if start < 0 {
+			start = 0
+		}
+		for _, previous := range picked[start:i] {
+			if previous == path {
+				t.Fatalf("%s picked again within %d tracks", path, localRepeatWindow)
+			}
+		}
+	}
+}
+
+func TestLocalSourceRescan(t *testing.T) {
+	root := newTestLibrary(t, "a.mp3")
+
+	source, err := NewLocalSource(root)
+	if err != nil {
+		t.Fatalf("cannot create source: %s", err)
+	}
+
+	// A single file is repeated.
+	tracks, err := source.NextTracks("", nil)
+	if err != nil {
+		t.Fatalf("cannot get tracks: %s", err)
+	}
+	for _, track := range tracks {
+		if filepath.Base(track.path) != "a.mp3" {
+			t.Fatalf("got track %s, expected a.mp3", track.path)
+		}
+	}
+
+	// The files added in the meantime are picked with the next batch.
+	addTestFile(t, root, "b.mp3")
+	tracks, err = source.NextTracks("", nil)
+	if err != nil {
+		t.Fatalf("cannot get tracks: %s", err)
+	}
+	if len(source.files) != 2 {
+		t.Fatalf("got files %v after rescan", source.files)
+	}
+	added := false
+	for _, track := range tracks {
+		added = added || filepath.Base(track.path) == "b.mp3"
+	}
+	if !added {
+		t.Errorf("added file never picked")
+	}
+
+	// Removing every file fails the batch.
+	err = os.Remove(filepath.Join(root, "a.mp3"))
+	if err == nil {
+		err = os.Remove(filepath.Join(root, "b.mp3"))
+	}
+	if err != nil {
+		t.Fatalf("cannot remove files: %s", err)
+	}
+	_, err = source.NextTracks("", nil)
+	if err != ErrNoTracksFound {
+		t.Errorf("got error %v, expected %v", err, ErrNoTracksFound)
+	}
+}
@@ -0,0 +1,83 @@
+package musiko
+
+import (
+	"bytes"
+	"log"
+	"math"
+)
+
+const (
+	replayGainReference = -18.0 // LUFS, reference loudness of the ReplayGain track gains sent by Pandora.
+	minLoudness         = -70.0 // LUFS, absolute gate of EBU R128, reported for silent tracks.
+	loudnessTolerance   = 0.5   // dB, smaller gains are not worth re-encoding the track.
+)
+
+// Loudness is the result of the normalization of a track.
+type Loudness struct {
+	Integrated float64 `json:"integrated"` // In LUFS.
+	Gain       float64 `json:"gain"`       // In dB, applied to reach the target.
+	Measured   bool    `json:"measured"`   // False if estimated from the track gain sent by Pandora.
+}
+
+// Loudness returns the loudness of the track, or nil if it was not normalized.
+func (t *Track) Loudness() *Loudness {
+	return t.loudness
+}
+
+// measureLoudness returns the integrated loudness of the track, using its track gain if known.
+func (t *Track) measureLoudness() (float64, bool, error) {
+	if t.trackGain != nil {
+		return replayGainReference - *t.trackGain, false, nil
+	}
+
+	if t.path != "" {
+		integrated, err := FfmpegLoudness(t.context(), t.path, nil)
+		return integrated, true, err
+	}
+
+	data, err := t.GetData()
+	if err != nil {
+		return 0, false, err
+	}
+
+	integrated, err := FfmpegLoudness(t.context(), "-", bytes.NewReader(data))
+	return integrated, true, err
+}
+
+// normalize measures the loudness of the track, and makes it and its alternate renditions split with the gain reaching the target of the profile.
+// Normalized tracks are re-encoded with ffmpeg instead of being split natively.
+func (s *Stream) normalize(track *Track) {
+	if !s.options.Profile.Normalizes() {
+		return
+	}
+
+	integrated, measured, err := track.measureLoudness()
+	if err != nil {
+		log.Printf("Cannot measure track loudness: %s (%s).\n", err.Error(), track.id.String())
+		return
+	}
+
+	// Silence cannot be normalized.
+	if integrated <= minLoudness {
+		return
+	}
+
+	gain := s.options.Profile.Loudness - integrated
+	if math.Abs(gain) < loudnessTolerance {
+		gain = 0
+	}
+	track.loudness = &Loudness{integrated, gain, measured}
+
+	if gain == 0 {
+		log.Printf("Track loudness: %.1f LUFS, no gain (%s).\n", integrated, track.id.String())
+		return
+	}
+	log.Printf("Track loudness: %.1f LUFS, gain: %+.1f dB, re-encoding %d rendition(s) (%s).\n", integrated, gain, 1+len(track.alternates), track.id.String())
+
+	for _, rendition := range append([]*Track{track}, track.alternates...) {
+		profile := s.options.renditionProfile(renditionName(rendition))
+		rendition.codec = profile.ffmpegArgs(gain)
+		rendition.codecs = profile.codecs()
+		rendition.native = false
+	}
+}
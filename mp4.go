@@ -0,0 +1,675 @@
+package musiko
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	maxMoovSize = 64 << 20
+	maxSamples  = 1 << 21 // About 12 hours of AAC frames at 48kHz.
+)
+
+var (
+	ErrUnsupportedMedia = errors.New("unsupported media, only AAC in MP4 can be split natively")
+	ErrInvalidMP4       = errors.New("invalid or truncated mp4 file")
+	ErrNotProgressive   = errors.New("mp4 file cannot be read progressively")
+)
+
+// aacTrack is the audio track of an MP4 file, as needed by the MPEG-TS muxer.
+type aacTrack struct {
+	config    aacConfig
+	timescale uint32
+	samples   []aacSample
+}
+
+type aacSample struct {
+	data     []byte
+	offset   uint64
+	size     uint32
+	duration uint32 // In timescale units.
+}
+
+// aacConfig is the subset of the AudioSpecificConfig that can be expressed in ADTS headers.
+type aacConfig struct {
+	profile        byte // Original object type, including SBR and PS.
+	objectType     byte
+	frequencyIndex byte
+	channels       byte
+}
+
+// codecs returns the RFC 6381 codecs string of the track.
+func (c aacConfig) codecs() string {
+	return fmt.Sprintf("mp4a.40.%d", c.profile)
+}
+
+type mp4Box struct {
+	kind string
+	data []byte
+}
+
+// mp4Boxes lists the boxes contained in data.
+func mp4Boxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrInvalidMP4
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+
+		switch size {
+		case 0:
+			// Box extends to the end of the file.
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, ErrInvalidMP4
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+
+		if size < header || size > uint64(len(data)) {
+			return nil, ErrInvalidMP4
+		}
+
+		boxes = append(boxes, mp4Box{kind, data[header:size]})
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
+
+// mp4Child returns the first box of the given kind found in data.
+func mp4Child(data []byte, kind string) ([]byte, error) {
+	boxes, err := mp4Boxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range boxes {
+		if b.kind == kind {
+			return b.data, nil
+		}
+	}
+
+	return nil, ErrUnsupportedMedia
+}
+
+// mp4Path follows a path of nested boxes.
+func mp4Path(data []byte, kinds ...string) ([]byte, error) {
+	var err error
+	for _, kind := range kinds {
+		data, err = mp4Child(data, kind)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// demuxAAC extracts the AAC frames of the first audio track of an MP4 file.
+func demuxAAC(data []byte) (*aacTrack, error) {
+	moov, err := mp4Path(data, "moov")
+	if err != nil {
+		return nil, err
+	}
+
+	track, err := parseMoov(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range track.samples {
+		sample := &track.samples[i]
+		end := sample.offset + uint64(sample.size)
+		if end > uint64(len(data)) {
+			return nil, ErrInvalidMP4
+		}
+		sample.data = data[sample.offset:end]
+	}
+
+	return track, nil
+}
+
+// streamAAC reads an MP4 file progressively, calling onTrack once the moov box is parsed and onSample for every frame.
+// The moov box must come before the mdat one and the samples must be stored in order, otherwise ErrNotProgressive is returned.
+func streamAAC(r io.Reader, onTrack func(*aacTrack), onSample func(aacSample)) error {
+	var (
+		track    *aacTrack
+		position uint64
+		next     int
+	)
+
+	header := make([]byte, 16)
+	for {
+		_, err := io.ReadFull(r, header[:8])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		size := uint64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		headerSize := uint64(8)
+
+		if size == 1 {
+			_, err = io.ReadFull(r, header[8:])
+			if err != nil {
+				return err
+			}
+			size = binary.BigEndian.Uint64(header[8:])
+			headerSize = 16
+		}
+
+		// A zero size means that the box extends to the end of the file.
+		toEnd := size == 0
+		if !toEnd && size < headerSize {
+			return ErrInvalidMP4
+		}
+
+		position += headerSize
+		end := position + size - headerSize
+
+		switch kind {
+		case "moov":
+			if toEnd || size-headerSize > maxMoovSize {
+				return ErrInvalidMP4
+			}
+
+			moov := make([]byte, size-headerSize)
+			_, err = io.ReadFull(r, moov)
+			if err != nil {
+				return err
+			}
+			position = end
+
+			track, err = parseMoov(moov)
+			if err != nil {
+				return err
+			}
+			onTrack(track)
+		case "mdat":
+			if track == nil {
+				return ErrNotProgressive
+			}
+
+			for ; next < len(track.samples); next++ {
+				sample := track.samples[next]
+				if sample.offset < position {
+					return ErrNotProgressive
+				}
+				if !toEnd && sample.offset+uint64(sample.size) > end {
+					break
+				}
+
+				_, err = io.CopyN(ioutil.Discard, r, int64(sample.offset-position))
+				if err != nil {
+					return err
+				}
+
+				sample.data = make([]byte, sample.size)
+				_, err = io.ReadFull(r, sample.data)
+				if err != nil {
+					return err
+				}
+				position = sample.offset + uint64(sample.size)
+
+				onSample(sample)
+			}
+
+			if toEnd {
+				_, err = io.Copy(ioutil.Discard, r)
+				if err != nil {
+					return err
+				}
+				break
+			}
+
+			_, err = io.CopyN(ioutil.Discard, r, int64(end-position))
+			if err != nil {
+				return err
+			}
+			position = end
+		default:
+			if toEnd {
+				_, err = io.Copy(ioutil.Discard, r)
+			} else {
+				_, err = io.CopyN(ioutil.Discard, r, int64(end-position))
+			}
+			if err != nil {
+				return err
+			}
+			position = end
+		}
+
+		if toEnd {
+			break
+		}
+	}
+
+	if track == nil {
+		return ErrUnsupportedMedia
+	}
+	if next != len(track.samples) {
+		return ErrInvalidMP4
+	}
+
+	return nil
+}
+
+// parseMoov reads the sample table of the first audio track, without the samples data.
+func parseMoov(moov []byte) (*aacTrack, error) {
+	traks, err := mp4Boxes(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, trak := range traks {
+		if trak.kind != "trak" {
+			continue
+		}
+
+		hdlr, err := mp4Path(trak.data, "mdia", "hdlr")
+		if err != nil || len(hdlr) < 12 || string(hdlr[8:12]) != "soun" {
+			continue
+		}
+
+		return parseAACTrack(trak.data)
+	}
+
+	return nil, ErrUnsupportedMedia
+}
+
+func parseAACTrack(trak []byte) (*aacTrack, error) {
+	track := new(aacTrack)
+
+	mdhd, err := mp4Path(trak, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	if len(mdhd) < 24 {
+		return nil, ErrInvalidMP4
+	}
+	if mdhd[0] == 1 {
+		if len(mdhd) < 32 {
+			return nil, ErrInvalidMP4
+		}
+		track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		track.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	if track.timescale == 0 {
+		return nil, ErrInvalidMP4
+	}
+
+	stbl, err := mp4Path(trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return nil, err
+	}
+
+	stsd, err := mp4Child(stbl, "stsd")
+	if err != nil {
+		return nil, err
+	}
+	track.config, err = parseSampleDescription(stsd)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes, err := parseSampleSizes(stbl)
+	if err != nil {
+		return nil, err
+	}
+
+	durations, err := parseSampleDurations(stbl, len(sizes))
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := parseSampleOffsets(stbl, sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	track.samples = make([]aacSample, len(sizes))
+	for i, size := range sizes {
+		track.samples[i] = aacSample{offset: offsets[i], size: size, duration: durations[i]}
+	}
+
+	if len(track.samples) == 0 {
+		return nil, ErrInvalidMP4
+	}
+
+	return track, nil
+}
+
+// parseSampleDescription reads the AudioSpecificConfig of an 'mp4a' sample entry.
+func parseSampleDescription(stsd []byte) (aacConfig, error) {
+	if len(stsd) < 8 {
+		return aacConfig{}, ErrInvalidMP4
+	}
+
+	entries, err := mp4Boxes(stsd[8:])
+	if err != nil {
+		return aacConfig{}, err
+	}
+	if len(entries) == 0 || entries[0].kind != "mp4a" {
+		return aacConfig{}, ErrUnsupportedMedia
+	}
+
+	entry := entries[0].data
+	if len(entry) < 28 {
+		return aacConfig{}, ErrInvalidMP4
+	}
+
+	// QuickTime sound descriptions version 1 and 2 have extra fields.
+	skip := 28
+	switch binary.BigEndian.Uint16(entry[8:]) {
+	case 1:
+		skip += 16
+	case 2:
+		skip += 36
+	}
+	if len(entry) < skip {
+		return aacConfig{}, ErrInvalidMP4
+	}
+
+	esds, err := mp4Child(entry[skip:], "esds")
+	if err != nil {
+		// QuickTime files wrap the esds box in a 'wave' box.
+		esds, err = mp4Path(entry[skip:], "wave", "esds")
+		if err != nil {
+			return aacConfig{}, err
+		}
+	}
+	if len(esds) < 4 {
+		return aacConfig{}, ErrInvalidMP4
+	}
+
+	asc, err := parseESDescriptor(esds[4:])
+	if err != nil {
+		return aacConfig{}, err
+	}
+
+	return parseAudioSpecificConfig(asc)
+}
+
+// readDescriptor reads an MPEG-4 descriptor, returning its tag, payload and the remaining data.
+func readDescriptor(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, ErrInvalidMP4
+	}
+
+	// The length takes up to 4 bytes, the last one without the continuation bit.
+	tag := data[0]
+	length := 0
+	i := 1
+	for {
+		if i >= len(data) || i > 4 {
+			return 0, nil, nil, ErrInvalidMP4
+		}
+
+		b := data[i]
+		i++
+		length = length<<7 | int(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if i+length > len(data) {
+		return 0, nil, nil, ErrInvalidMP4
+	}
+
+	return tag, data[i : i+length], data[i+length:], nil
+}
+
+// parseESDescriptor returns the DecoderSpecificInfo (the AudioSpecificConfig) of an ES_Descriptor.
+func parseESDescriptor(data []byte) ([]byte, error) {
+	tag, es, _, err := readDescriptor(data)
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x03 || len(es) < 3 {
+		return nil, ErrInvalidMP4
+	}
+
+	// Skip the optional dependency, URL and OCR fields.
+	flags := es[2]
+	skip := 3
+	if flags&0x80 != 0 {
+		skip += 2
+	}
+	if flags&0x40 != 0 {
+		if len(es) <= skip {
+			return nil, ErrInvalidMP4
+		}
+		skip += int(es[skip]) + 1
+	}
+	if flags&0x20 != 0 {
+		skip += 2
+	}
+	if len(es) < skip {
+		return nil, ErrInvalidMP4
+	}
+	es = es[skip:]
+
+	tag, decoderConfig, _, err := readDescriptor(es)
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x04 || len(decoderConfig) < 13 {
+		return nil, ErrInvalidMP4
+	}
+
+	// MPEG-4 audio or MPEG-2 AAC (main, LC, SSR).
+	switch decoderConfig[0] {
+	case 0x40, 0x66, 0x67, 0x68:
+	default:
+		return nil, ErrUnsupportedMedia
+	}
+
+	tag, asc, _, err := readDescriptor(decoderConfig[13:])
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x05 {
+		return nil, ErrInvalidMP4
+	}
+
+	return asc, nil
+}
+
+func parseAudioSpecificConfig(asc []byte) (aacConfig, error) {
+	if len(asc) < 2 {
+		return aacConfig{}, ErrInvalidMP4
+	}
+
+	r := bitReader{data: asc}
+	config := aacConfig{
+		objectType:     byte(r.read(5)),
+		frequencyIndex: byte(r.read(4)),
+	}
+	if config.frequencyIndex == 15 {
+		// Explicit frequencies cannot be expressed in ADTS headers.
+		return aacConfig{}, ErrUnsupportedMedia
+	}
+	config.channels = byte(r.read(4))
+	config.profile = config.objectType
+
+	// HE-AAC (SBR and PS) is carried in ADTS as its core AAC object type and frequency.
+	if config.objectType == 5 || config.objectType == 29 {
+		if r.read(4) == 15 {
+			r.read(24)
+		}
+		config.objectType = byte(r.read(5))
+	}
+
+	if r.err || config.objectType < 1 || config.objectType > 4 || config.channels == 0 || config.channels > 7 {
+		return aacConfig{}, ErrUnsupportedMedia
+	}
+
+	return config, nil
+}
+
+func parseSampleSizes(stbl []byte) ([]uint32, error) {
+	stsz, err := mp4Child(stbl, "stsz")
+	if err != nil {
+		return nil, err
+	}
+	if len(stsz) < 12 {
+		return nil, ErrInvalidMP4
+	}
+
+	constant := binary.BigEndian.Uint32(stsz[4:])
+	count := int(binary.BigEndian.Uint32(stsz[8:]))
+
+	// Constant sizes are not listed, the count alone cannot be checked against the box.
+	if count > maxSamples || constant == 0 && len(stsz) < 12+count*4 {
+		return nil, ErrInvalidMP4
+	}
+
+	sizes := make([]uint32, count)
+	for i := range sizes {
+		if constant != 0 {
+			sizes[i] = constant
+		} else {
+			sizes[i] = binary.BigEndian.Uint32(stsz[12+i*4:])
+		}
+	}
+
+	return sizes, nil
+}
+
+func parseSampleDurations(stbl []byte, count int) ([]uint32, error) {
+	stts, err := mp4Child(stbl, "stts")
+	if err != nil {
+		return nil, err
+	}
+	if len(stts) < 8 {
+		return nil, ErrInvalidMP4
+	}
+
+	entries := int(binary.BigEndian.Uint32(stts[4:]))
+	if len(stts) < 8+entries*8 {
+		return nil, ErrInvalidMP4
+	}
+
+	durations := make([]uint32, 0, count)
+	for i := 0; i < entries && len(durations) < count; i++ {
+		run := binary.BigEndian.Uint32(stts[8+i*8:])
+		delta := binary.BigEndian.Uint32(stts[12+i*8:])
+		for j := uint32(0); j < run && len(durations) < count; j++ {
+			durations = append(durations, delta)
+		}
+	}
+
+	if len(durations) != count {
+		return nil, ErrInvalidMP4
+	}
+
+	return durations, nil
+}
+
+func parseSampleOffsets(stbl []byte, sizes []uint32) ([]uint64, error) {
+	var chunks []uint64
+
+	if stco, err := mp4Child(stbl, "stco"); err == nil {
+		if len(stco) < 8 {
+			return nil, ErrInvalidMP4
+		}
+		count := int(binary.BigEndian.Uint32(stco[4:]))
+		if len(stco) < 8+count*4 {
+			return nil, ErrInvalidMP4
+		}
+		for i := 0; i < count; i++ {
+			chunks = append(chunks, uint64(binary.BigEndian.Uint32(stco[8+i*4:])))
+		}
+	} else if co64, err := mp4Child(stbl, "co64"); err == nil {
+		if len(co64) < 8 {
+			return nil, ErrInvalidMP4
+		}
+		count := int(binary.BigEndian.Uint32(co64[4:]))
+		if len(co64) < 8+count*8 {
+			return nil, ErrInvalidMP4
+		}
+		for i := 0; i < count; i++ {
+			chunks = append(chunks, binary.BigEndian.Uint64(co64[8+i*8:]))
+		}
+	} else {
+		return nil, ErrInvalidMP4
+	}
+
+	stsc, err := mp4Child(stbl, "stsc")
+	if err != nil {
+		return nil, err
+	}
+	if len(stsc) < 8 {
+		return nil, ErrInvalidMP4
+	}
+	entries := int(binary.BigEndian.Uint32(stsc[4:]))
+	if entries == 0 || len(stsc) < 8+entries*12 {
+		return nil, ErrInvalidMP4
+	}
+
+	offsets := make([]uint64, 0, len(sizes))
+	for i := 0; i < entries; i++ {
+		first := int(binary.BigEndian.Uint32(stsc[8+i*12:]))
+		perChunk := int(binary.BigEndian.Uint32(stsc[12+i*12:]))
+
+		last := len(chunks) + 1
+		if i+1 < entries {
+			last = int(binary.BigEndian.Uint32(stsc[8+(i+1)*12:]))
+		}
+
+		// Chunks are numbered from 1, in increasing order.
+		if first < 1 || last <= first {
+			return nil, ErrInvalidMP4
+		}
+
+		for chunk := first; chunk < last && chunk <= len(chunks); chunk++ {
+			offset := chunks[chunk-1]
+			for j := 0; j < perChunk && len(offsets) < len(sizes); j++ {
+				offsets = append(offsets, offset)
+				offset += uint64(sizes[len(offsets)-1])
+			}
+		}
+	}
+
+	if len(offsets) != len(sizes) {
+		return nil, ErrInvalidMP4
+	}
+
+	return offsets, nil
+}
+
+// bitReader reads big endian bit fields, setting err instead of panicking on overflow.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos/8 >= len(r.data) {
+			r.err = true
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
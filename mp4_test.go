@@ -0,0 +1,173 @@
+package musiko
+
+import (
+	"bytes"
+	"github.com/scotow/musiko/pandoratest"
+	"testing"
+	"time"
+)
+
+func TestDemuxAAC(t *testing.T) {
+	data := pandoratest.SilentM4A(5 * time.Second)
+
+	track, err := demuxAAC(data)
+	if err != nil {
+		t.Fatalf("cannot demux: %s", err)
+	}
+
+	if track.timescale != 44100 {
+		t.Errorf("got timescale %d, expected 44100", track.timescale)
+	}
+	if track.config != (aacConfig{profile: 2, objectType: 2, frequencyIndex: 4, channels: 2}) {
+		t.Errorf("got config %+v, expected AAC-LC 44100Hz stereo", track.config)
+	}
+	if track.config.codecs() != "mp4a.40.2" {
+		t.Errorf("got codecs %s", track.config.codecs())
+	}
+
+	// 5 sec of 1024 samples frames.
+	if len(track.samples) != 215 {
+		t.Fatalf("got %d samples, expected 215", len(track.samples))
+	}
+	for i, sample := range track.samples {
+		if sample.duration != 1024 || len(sample.data) != int(sample.size) || sample.size == 0 {
+			t.Fatalf("invalid sample %d: %+v", i, sample)
+		}
+	}
+}
+
+func TestDemuxAACTruncated(t *testing.T) {
+	data := pandoratest.SilentM4A(5 * time.Second)
+
+	for _, size := range []int{0, 7, 100, len(data) / 2, len(data) - 1} {
+		_, err := demuxAAC(data[:size])
+		if err == nil {
+			t.Errorf("demuxed a file truncated to %d bytes", size)
+		}
+	}
+}
+
+// testSampleTable returns the content of an stbl box with 2 chunks at 100 and 200, and the given stsc entries.
+func testSampleTable(stsc ...uint32) []byte {
+	return box("stbl",
+		fullBox("stco", 0, 0, u32s(2, 100, 200)),
+		fullBox("stsc", 0, 0, u32s(uint32(len(stsc)/3)), u32s(stsc...)),
+	)[8:]
+}
+
+func TestParseSampleOffsets(t *testing.T) {
+	sizes := []uint32{10, 10, 10, 10}
+
+	tests := []struct {
+		name    string
+		stsc    []uint32
+		offsets []uint64
+	}{
+		{"one entry", []uint32{1, 2, 1}, []uint64{100, 110, 200, 210}},
+		{"two entries", []uint32{1, 3, 1, 2, 1, 1}, []uint64{100, 110, 120, 200}},
+		{"first chunk zero", []uint32{0, 2, 1}, nil},
+		{"same first chunk", []uint32{1, 2, 1, 1, 2, 1}, nil},
+		{"decreasing first chunk", []uint32{2, 2, 1, 1, 2, 1}, nil},
+		{"missing chunk", []uint32{3, 4, 1}, nil},
+		{"too few samples", []uint32{1, 1, 1}, nil},
+	}
+
+	for _, test := range tests {
+		offsets, err := parseSampleOffsets(testSampleTable(test.stsc...), sizes)
+		if test.offsets == nil {
+			if err != ErrInvalidMP4 {
+				t.Errorf("%s: got %v, %v, expected %v", test.name, offsets, err, ErrInvalidMP4)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(offsets) != len(test.offsets) {
+			t.Errorf("%s: got offsets %v, expected %v", test.name, offsets, test.offsets)
+			continue
+		}
+		for i := range offsets {
+			if offsets[i] != test.offsets[i] {
+				t.Errorf("%s: got offsets %v, expected %v", test.name, offsets, test.offsets)
+				break
+			}
+		}
+	}
+}
+
+func TestReadDescriptor(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		payload   []byte
+		remaining []byte
+	}{
+		{"short length", []byte{0x05, 0x02, 0xAA, 0xBB, 0xCC}, []byte{0xAA, 0xBB}, []byte{0xCC}},
+		{"long length", []byte{0x05, 0x80, 0x80, 0x80, 0x01, 0xAA}, []byte{0xAA}, []byte{}},
+		{"empty payload", []byte{0x05, 0x00}, []byte{}, []byte{}},
+		{"truncated payload", []byte{0x05, 0x03, 0xAA}, nil, nil},
+		{"truncated length", []byte{0x05, 0x80, 0x80}, nil, nil},
+		{"length too long", []byte{0x05, 0x80, 0x80, 0x80, 0x80, 0x01, 0xAA}, nil, nil},
+		{"no length", []byte{0x05}, nil, nil},
+	}
+
+	for _, test := range tests {
+		tag, payload, remaining, err := readDescriptor(test.data)
+		if test.payload == nil {
+			if err != ErrInvalidMP4 {
+				t.Errorf("%s: got %v, expected %v", test.name, err, ErrInvalidMP4)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if tag != 0x05 || !bytes.Equal(payload, test.payload) || !bytes.Equal(remaining, test.remaining) {
+			t.Errorf("%s: got %x %x %x", test.name, tag, payload, remaining)
+		}
+	}
+}
+
+func TestParseSampleSizes(t *testing.T) {
+	tests := []struct {
+		name  string
+		stsz  []byte
+		sizes []uint32
+	}{
+		{"constant", u32s(10, 3), []uint32{10, 10, 10}},
+		{"listed", u32s(0, 3, 1, 2, 3), []uint32{1, 2, 3}},
+		{"truncated list", u32s(0, 3, 1, 2), nil},
+		{"huge constant count", u32s(10, 0xFFFFFFFF), nil},
+		{"huge listed count", u32s(0, 0xFFFFFFFF, 1), nil},
+	}
+
+	for _, test := range tests {
+		sizes, err := parseSampleSizes(box("stbl", fullBox("stsz", 0, 0, test.stsz))[8:])
+		if test.sizes == nil {
+			if err != ErrInvalidMP4 {
+				t.Errorf("%s: got %d sizes, %v, expected %v", test.name, len(sizes), err, ErrInvalidMP4)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(sizes) != len(test.sizes) {
+			t.Errorf("%s: got sizes %v, expected %v", test.name, sizes, test.sizes)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != test.sizes[i] {
+				t.Errorf("%s: got sizes %v, expected %v", test.name, sizes, test.sizes)
+				break
+			}
+		}
+	}
+}
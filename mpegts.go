@@ -0,0 +1,404 @@
+package musiko
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"time"
+)
+
+const (
+	tsPacketSize   = 188
+	tsPATPID       = 0x0000
+	tsPMTPID       = 0x1000
+	tsAudioPID     = 0x0100
+	tsClock        = 90000
+	tsInitialDelay = 126000 // 1.4s, like ffmpeg, so PCR never goes negative.
+	tsFramesPerPES = 5
+	tsStreamADTS   = 0x0F
+)
+
+// NativeSplitTS splits an AAC-in-MP4 file into MPEG-TS parts of segmentTime without ffmpeg.
+func NativeSplitTS(data []byte, segmentTime time.Duration) (*m3u8.MediaPlaylist, []*Part, error) {
+	track, err := demuxAAC(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segmenter := newTSSegmenter(track, segmentTime)
+	parts := make([]*Part, 0)
+
+	for _, sample := range track.samples {
+		if part := segmenter.add(sample); part != nil {
+			parts = append(parts, part)
+		}
+	}
+	if part := segmenter.flush(); part != nil {
+		parts = append(parts, part)
+	}
+
+	playlist, err := partsPlaylist(parts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return playlist, parts, nil
+}
+
+// partsPlaylist builds the playlist of a track from its parts.
+func partsPlaylist(parts []*Part) (*m3u8.MediaPlaylist, error) {
+	playlist, err := m3u8.NewMediaPlaylist(0, uint(len(parts)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range parts {
+		err = playlist.AppendSegment(part.seg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return playlist, nil
+}
+
+// tsSegmenter cuts a flow of AAC frames in parts, on frame boundaries, once the target duration is reached.
+// If boundaries is set, parts are cut on the frames closest to the received times instead, to stay aligned with another rendition.
+type tsSegmenter struct {
+	muxer     *tsMuxer
+	target    float64 // In seconds.
+	timescale uint32
+	pending   []aacSample
+	elapsed   uint64
+	position  uint64
+	count     int
+
+	aligned    bool
+	boundaries <-chan float64
+	next       float64
+	waiting    bool
+}
+
+func newTSSegmenter(track *aacTrack, target time.Duration) *tsSegmenter {
+	return &tsSegmenter{
+		muxer:     newTSMuxer(track.config),
+		target:    target.Seconds(),
+		timescale: track.timescale,
+	}
+}
+
+// newAlignedTSSegmenter creates a segmenter cutting parts on boundaries, the end times of the parts of the reference rendition, in seconds.
+func newAlignedTSSegmenter(track *aacTrack, boundaries <-chan float64) *tsSegmenter {
+	s := newTSSegmenter(track, 0)
+	s.aligned = true
+	s.boundaries = boundaries
+	s.waiting = true
+
+	return s
+}
+
+// add buffers a frame and returns a part if the target duration is reached.
+func (s *tsSegmenter) add(sample aacSample) *Part {
+	if s.aligned {
+		var part *Part
+		if s.reached(sample) {
+			part = s.flush()
+		}
+
+		s.pending = append(s.pending, sample)
+		s.elapsed += uint64(sample.duration)
+		s.position += uint64(sample.duration)
+
+		return part
+	}
+
+	s.pending = append(s.pending, sample)
+	s.elapsed += uint64(sample.duration)
+	s.position += uint64(sample.duration)
+
+	if float64(s.elapsed)/float64(s.timescale) < s.target {
+		return nil
+	}
+
+	return s.flush()
+}
+
+// reached returns true if the next boundary is closer to the start of the sample than to its end.
+// Blocks until the boundary is known, the remaining frames go to the last part once boundaries is closed.
+func (s *tsSegmenter) reached(sample aacSample) bool {
+	if s.boundaries == nil {
+		return false
+	}
+
+	if s.waiting {
+		next, ok := <-s.boundaries
+		if !ok {
+			s.boundaries = nil
+			return false
+		}
+
+		s.next = next
+		s.waiting = false
+	}
+
+	middle := (float64(s.position) + float64(sample.duration)/2) / float64(s.timescale)
+	if middle < s.next {
+		return false
+	}
+
+	s.waiting = true
+	return true
+}
+
+// flush muxes the buffered frames in a part, if any.
+func (s *tsSegmenter) flush() *Part {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	seg := &m3u8.MediaSegment{
+		URI:      fmt.Sprintf("%d.ts", s.count),
+		Duration: float64(s.elapsed) / float64(s.timescale),
+	}
+	part := &Part{data: s.muxer.segment(s.pending, s.timescale), seg: seg}
+
+	s.pending = nil
+	s.elapsed = 0
+	s.count++
+
+	return part
+}
+
+// tsMuxer writes ADTS frames in MPEG-TS packets, keeping continuity counters and timestamps across the parts of a track.
+type tsMuxer struct {
+	config     aacConfig
+	continuity map[uint16]byte
+	pts        uint64 // In 90kHz units, relative to the track start.
+	remainder  uint64 // Timescale units not yet converted to pts.
+}
+
+func newTSMuxer(config aacConfig) *tsMuxer {
+	return &tsMuxer{
+		config:     config,
+		continuity: make(map[uint16]byte),
+	}
+}
+
+// segment muxes the samples in a standalone part starting with a PAT and a PMT.
+func (m *tsMuxer) segment(samples []aacSample, timescale uint32) []byte {
+	buffer := new(bytes.Buffer)
+
+	m.writeSection(buffer, tsPATPID, patSection())
+	m.writeSection(buffer, tsPMTPID, pmtSection())
+
+	for i := 0; i < len(samples); i += tsFramesPerPES {
+		end := i + tsFramesPerPES
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		var payload []byte
+		for _, sample := range samples[i:end] {
+			payload = append(payload, m.adtsHeader(len(sample.data))...)
+			payload = append(payload, sample.data...)
+		}
+
+		pts := m.pts + tsInitialDelay
+		m.writePES(buffer, pts, payload)
+
+		for _, sample := range samples[i:end] {
+			ticks := uint64(sample.duration)*tsClock + m.remainder
+			m.pts += ticks / uint64(timescale)
+			m.remainder = ticks % uint64(timescale)
+		}
+	}
+
+	return buffer.Bytes()
+}
+
+func (m *tsMuxer) adtsHeader(size int) []byte {
+	length := size + 7
+	return []byte{
+		0xFF,
+		0xF1, // MPEG-4, layer 0, no CRC.
+		(m.config.objectType-1)<<6 | m.config.frequencyIndex<<2 | m.config.channels>>2,
+		(m.config.channels&0x03)<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+func (m *tsMuxer) nextContinuity(pid uint16) byte {
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0F
+	return cc
+}
+
+// writeSection writes a PSI section in a single packet, prefixed with its pointer field.
+func (m *tsMuxer) writeSection(buffer *bytes.Buffer, pid uint16, section []byte) {
+	packet := make([]byte, tsPacketSize)
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8)
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | m.nextContinuity(pid)
+	packet[4] = 0x00
+
+	n := copy(packet[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		packet[i] = 0xFF
+	}
+
+	buffer.Write(packet)
+}
+
+// writePES writes an audio PES packet, with a PCR on its first TS packet.
+func (m *tsMuxer) writePES(buffer *bytes.Buffer, pts uint64, payload []byte) {
+	// Random access indicator and PCR.
+	m.writePackets(buffer, tsAudioPID, pesPacket(0xC0, 0x80, pts, payload), append([]byte{0x50}, encodePCR(pts)...))
+}
+
+// pesPacket builds a PES packet with a PTS only header.
+func pesPacket(stream byte, flags byte, pts uint64, payload []byte) []byte {
+	pes := make([]byte, 0, 14+len(payload))
+	pes = append(pes, 0x00, 0x00, 0x01, stream)
+
+	length := 8 + len(payload)
+	if length > 0xFFFF {
+		length = 0
+	}
+	pes = append(pes, byte(length>>8), byte(length), flags, 0x80, 0x05)
+	pes = append(pes, encodePTS(pts)...)
+	return append(pes, payload...)
+}
+
+// writePackets splits a PES packet in TS packets, with the adaptation field on the first one, if any, and stuffing on the last one.
+func (m *tsMuxer) writePackets(buffer *bytes.Buffer, pid uint16, pes []byte, firstAdaptation []byte) {
+	first := true
+	for len(pes) > 0 {
+		packet := make([]byte, 4, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = byte(pid >> 8)
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(pid & 0xFF)
+
+		var adaptation []byte
+		if first {
+			adaptation = firstAdaptation
+		}
+
+		room := tsPacketSize - 4
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+
+		if len(pes) < room {
+			// Stuff the adaptation field so the payload ends the packet.
+			stuffing := room - len(pes)
+			if adaptation == nil {
+				if stuffing == 1 {
+					adaptation = []byte{}
+				} else {
+					adaptation = []byte{0x00}
+				}
+				stuffing -= 1 + len(adaptation)
+			}
+			adaptation = append(adaptation, bytes.Repeat([]byte{0xFF}, stuffing)...)
+			room = len(pes)
+		}
+
+		if adaptation != nil {
+			packet[3] = 0x30 | m.nextContinuity(pid)
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		} else {
+			packet[3] = 0x10 | m.nextContinuity(pid)
+		}
+
+		packet = append(packet, pes[:room]...)
+		pes = pes[room:]
+		first = false
+
+		buffer.Write(packet)
+	}
+}
+
+func encodePTS(pts uint64) []byte {
+	return []byte{
+		0x21 | byte(pts>>29)&0x0E,
+		byte(pts >> 22),
+		byte(pts>>14) | 0x01,
+		byte(pts >> 7),
+		byte(pts<<1) | 0x01,
+	}
+}
+
+func encodePCR(pcr uint64) []byte {
+	return []byte{
+		byte(pcr >> 25),
+		byte(pcr >> 17),
+		byte(pcr >> 9),
+		byte(pcr >> 1),
+		byte(pcr<<7) | 0x7E,
+		0x00,
+	}
+}
+
+func patSection() []byte {
+	return psiSection(0x00, 0x0001, []byte{
+		0x00, 0x01, // Program number.
+		0xE0 | byte(tsPMTPID>>8), byte(tsPMTPID & 0xFF),
+	})
+}
+
+// pmtSection returns the PMT of the native parts, declaring the ID3 metadata stream even if the part carries no tag,
+// so all the parts of a stream share the same program.
+func pmtSection() []byte {
+	pointer, metadata := metadataStream()
+
+	data := []byte{
+		0xE0 | byte(tsAudioPID>>8), byte(tsAudioPID & 0xFF), // PCR PID.
+		0xF0 | byte(len(pointer)>>8), byte(len(pointer)),
+	}
+	data = append(data, pointer...)
+	data = append(data,
+		tsStreamADTS,
+		0xE0|byte(tsAudioPID>>8), byte(tsAudioPID&0xFF),
+		0xF0, 0x00, // No ES info.
+	)
+	data = append(data, metadata...)
+
+	return psiSection(0x02, 0x0001, data)
+}
+
+func psiSection(table byte, id uint16, data []byte) []byte {
+	length := 5 + len(data) + 4
+	section := []byte{
+		table,
+		0xB0 | byte(length>>8), byte(length),
+		byte(id >> 8), byte(id),
+		0xC1, // Version 0, current.
+		0x00, 0x00,
+	}
+	section = append(section, data...)
+
+	crc := crc32MPEG(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
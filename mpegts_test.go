@@ -0,0 +1,142 @@
+package musiko
+
+import (
+	"github.com/scotow/musiko/pandoratest"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCRC32MPEG(t *testing.T) {
+	// Check value of CRC-32/MPEG-2.
+	if crc := crc32MPEG([]byte("123456789")); crc != 0x0376E6E7 {
+		t.Errorf("got crc %08x, expected 0376e6e7", crc)
+	}
+
+	// The CRC of a section including its CRC is zero.
+	for name, section := range map[string][]byte{"pat": patSection(), "pmt": pmtSection()} {
+		if crc := crc32MPEG(section); crc != 0 {
+			t.Errorf("%s section has an invalid crc", name)
+		}
+	}
+}
+
+func TestNativeSplitTS(t *testing.T) {
+	data := pandoratest.SilentM4A(25 * time.Second)
+	track, err := demuxAAC(data)
+	if err != nil {
+		t.Fatalf("cannot demux: %s", err)
+	}
+
+	playlist, parts, err := NativeSplitTS(data, defaultSegmentTime)
+	if err != nil {
+		t.Fatalf("cannot split: %s", err)
+	}
+	if len(parts) != 3 || playlist.Count() != 3 {
+		t.Fatalf("got %d parts, expected 3", len(parts))
+	}
+
+	var total float64
+	for i, part := range parts {
+		if len(part.data) == 0 || len(part.data)%tsPacketSize != 0 {
+			t.Errorf("part %d is %d bytes", i, len(part.data))
+		}
+		if i < len(parts)-1 && (part.seg.Duration < defaultSegmentTime.Seconds() || part.seg.Duration > defaultSegmentTime.Seconds()+0.1) {
+			t.Errorf("part %d lasts %f sec", i, part.seg.Duration)
+		}
+		total += part.seg.Duration
+	}
+
+	length := float64(len(track.samples)*1024) / 44100
+	if math.Abs(total-length) > 1e-6 {
+		t.Errorf("parts last %f sec, expected %f", total, length)
+	}
+}
+
+func TestNativeSplitTSSegmentTime(t *testing.T) {
+	data := pandoratest.SilentM4A(25 * time.Second)
+
+	for segmentTime, count := range map[time.Duration]int{4 * time.Second: 7, 5 * time.Second: 5, 30 * time.Second: 1} {
+		_, parts, err := NativeSplitTS(data, segmentTime)
+		if err != nil {
+			t.Fatalf("cannot split: %s", err)
+		}
+		if len(parts) != count {
+			t.Errorf("got %d parts of %s, expected %d", len(parts), segmentTime, count)
+		}
+		for i, part := range parts[:len(parts)-1] {
+			if part.seg.Duration < segmentTime.Seconds() || part.seg.Duration > segmentTime.Seconds()+0.1 {
+				t.Errorf("part %d of %s lasts %f sec", i, segmentTime, part.seg.Duration)
+			}
+		}
+	}
+}
+
+func TestNativeSplitTSTimestamps(t *testing.T) {
+	data := pandoratest.SilentM4A(25 * time.Second)
+	_, parts, err := NativeSplitTS(data, defaultSegmentTime)
+	if err != nil {
+		t.Fatalf("cannot split: %s", err)
+	}
+
+	var (
+		frames     uint64
+		continuity = make(map[int]int)
+	)
+	for i, part := range parts {
+		for offset := 0; offset < len(part.data); offset += tsPacketSize {
+			packet := part.data[offset : offset+tsPacketSize]
+			pid, start, payload := tsPayload(packet)
+			if pid < 0 || payload == nil {
+				t.Fatalf("part %d: invalid packet at %d", i, offset)
+			}
+
+			// Continuity counters go on across parts.
+			cc := int(packet[3] & 0x0F)
+			if last, exists := continuity[pid]; exists && cc != (last+1)&0x0F {
+				t.Fatalf("part %d: continuity of pid %d jumps from %d to %d", i, pid, last, cc)
+			}
+			continuity[pid] = cc
+
+			if pid != tsAudioPID || !start {
+				continue
+			}
+
+			// Each PES starts after the frames of the previous ones.
+			expected := tsInitialDelay + frames*1024*tsClock/44100
+			if pts := decodePTS(payload[9:14]); pts != expected {
+				t.Fatalf("part %d: got pts %d, expected %d", i, pts, expected)
+			}
+
+			// The PCR of the PES matches its PTS.
+			pcr := uint64(packet[6])<<25 | uint64(packet[7])<<17 | uint64(packet[8])<<9 | uint64(packet[9])<<1 | uint64(packet[10]>>7)
+			if pcr != expected {
+				t.Fatalf("part %d: got pcr %d, expected %d", i, pcr, expected)
+			}
+
+			// Count the ADTS frames of the PES.
+			pes := payload[14:]
+			for offset+tsPacketSize < len(part.data) {
+				next := part.data[offset+tsPacketSize : offset+2*tsPacketSize]
+				nextPID, nextStart, nextPayload := tsPayload(next)
+				if nextPID != tsAudioPID || nextStart {
+					break
+				}
+				pes = append(pes, nextPayload...)
+				offset += tsPacketSize
+				continuity[pid] = int(next[3] & 0x0F)
+			}
+			for len(pes) >= 7 {
+				if pes[0] != 0xFF || pes[1]&0xF0 != 0xF0 {
+					t.Fatalf("part %d: invalid adts header", i)
+				}
+				pes = pes[int(pes[3]&0x03)<<11|int(pes[4])<<3|int(pes[5]>>5):]
+				frames++
+			}
+		}
+	}
+
+	if frames != uint64(25*44100/1024) {
+		t.Errorf("got %d frames, expected %d", frames, 25*44100/1024)
+	}
+}
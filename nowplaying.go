@@ -0,0 +1,79 @@
+package musiko
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNothingPlaying = errors.New("nothing playing")
+)
+
+// QueuedTrack is a track of the queue. Duration is the one of its parts published so far, in seconds.
+type QueuedTrack struct {
+	Id       string    `json:"id"`
+	Info     TrackInfo `json:"info"`
+	Duration float64   `json:"duration"`
+}
+
+// NowPlaying is the position of the stream in its queue. Times are in seconds.
+type NowPlaying struct {
+	Track     QueuedTrack   `json:"track"`
+	Elapsed   float64       `json:"elapsed"`
+	Remaining float64       `json:"remaining"`
+	Paused    bool          `json:"paused"`
+	Next      []QueuedTrack `json:"next"`
+}
+
+// NowPlaying returns the head track of the queue with its elapsed and remaining time, and the next tracks.
+func (s *Stream) NowPlaying() (*NowPlaying, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.queue) == 0 || (s.state != running && s.state != paused) {
+		return nil, ErrNothingPlaying
+	}
+
+	head := s.queue[0]
+	playing := &NowPlaying{
+		Track:  queuedTrack(head),
+		Paused: s.state == paused,
+		Next:   make([]QueuedTrack, 0, len(s.queue)-1),
+	}
+
+	// Parts of the head track already removed from the playlist.
+	for _, part := range head.parts[:len(head.parts)-len(head.queue)] {
+		playing.Elapsed += part.seg.Duration
+	}
+
+	if len(head.queue) > 0 && head.queue[0] == s.current {
+		now := time.Now()
+		if playing.Paused {
+			now = s.pausedAt
+		}
+
+		elapsed := now.Sub(s.currentStart).Seconds()
+		if elapsed > s.current.seg.Duration {
+			elapsed = s.current.seg.Duration
+		}
+		if elapsed > 0 {
+			playing.Elapsed += elapsed
+		}
+	}
+	playing.Remaining = playing.Track.Duration - playing.Elapsed
+
+	for _, track := range s.queue[1:] {
+		playing.Next = append(playing.Next, queuedTrack(track))
+	}
+
+	return playing, nil
+}
+
+func queuedTrack(track *Track) QueuedTrack {
+	queued := QueuedTrack{Id: track.id.String(), Info: track.info}
+	for _, part := range track.parts {
+		queued.Duration += part.seg.Duration
+	}
+
+	return queued
+}
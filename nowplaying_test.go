@@ -0,0 +1,96 @@
+package musiko
+
+import (
+	"github.com/grafov/m3u8"
+	"math"
+	"testing"
+	"time"
+)
+
+// testQueuedTrack creates a track with published parts of the given durations, none of them played.
+func testQueuedTrack(name string, durations ...float64) *Track {
+	track := NewTrack("", TrackInfo{Name: name}, nil)
+	for _, duration := range durations {
+		part := &Part{seg: &m3u8.MediaSegment{Duration: duration}}
+		track.parts = append(track.parts, part)
+		track.queue = append(track.queue, part)
+	}
+
+	return track
+}
+
+func TestNowPlayingNothing(t *testing.T) {
+	stream, err := NewStream(nil, "", StreamOptions{})
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+
+	// Nothing plays before the stream starts, or with an empty queue.
+	stream.queue = append(stream.queue, testQueuedTrack("Song", 2))
+	if _, err := stream.NowPlaying(); err != ErrNothingPlaying {
+		t.Errorf("got error %v for a stopped stream, expected %v", err, ErrNothingPlaying)
+	}
+
+	stream.state = running
+	stream.queue = nil
+	if _, err := stream.NowPlaying(); err != ErrNothingPlaying {
+		t.Errorf("got error %v for an empty queue, expected %v", err, ErrNothingPlaying)
+	}
+}
+
+func TestNowPlaying(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   uint
+		started time.Duration // Time since the current part started.
+		paused  time.Duration // Time since the stream was paused.
+		elapsed float64
+	}{
+		{"playing", running, 500 * time.Millisecond, 0, 2.5},
+		{"paused", paused, 1500 * time.Millisecond, 500 * time.Millisecond, 3},
+		{"late", running, time.Minute, 0, 4},
+	}
+
+	for _, test := range tests {
+		stream, err := NewStream(nil, "", StreamOptions{})
+		if err != nil {
+			t.Fatalf("cannot create stream: %s", err)
+		}
+
+		// The first part of the head track was played, the second one is playing.
+		head := testQueuedTrack("Head", 2, 2, 1.5)
+		head.queue = head.queue[1:]
+		next := []*Track{testQueuedTrack("Next", 2, 2), testQueuedTrack("Last", 1)}
+		stream.queue = append([]*Track{head}, next...)
+
+		now := time.Now()
+		stream.state = test.state
+		stream.current = head.queue[0]
+		stream.currentStart = now.Add(-test.started)
+		stream.pausedAt = now.Add(-test.paused)
+
+		playing, err := stream.NowPlaying()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if playing.Track.Id != head.id.String() || playing.Track.Info.Name != "Head" || playing.Track.Duration != 5.5 {
+			t.Errorf("%s: got track %+v, expected the head track of 5.5s", test.name, playing.Track)
+		}
+		if playing.Paused != (test.state == paused) {
+			t.Errorf("%s: got paused %t", test.name, playing.Paused)
+		}
+		if math.Abs(playing.Elapsed-test.elapsed) > 0.1 || math.Abs(playing.Elapsed+playing.Remaining-5.5) > 1e-9 {
+			t.Errorf("%s: got %.3fs elapsed and %.3fs remaining, expected %.3fs elapsed", test.name, playing.Elapsed, playing.Remaining, test.elapsed)
+		}
+
+		if len(playing.Next) != len(next) {
+			t.Fatalf("%s: got %d next tracks, expected %d", test.name, len(playing.Next), len(next))
+		}
+		for i, track := range next {
+			if playing.Next[i].Id != track.id.String() || playing.Next[i].Info != track.info {
+				t.Errorf("%s: got next track %+v, expected %s", test.name, playing.Next[i], track.info.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package musiko
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultSegmentTime = 10 * time.Second
+	defaultWindowSize  = 6 // About 60 sec of music.
+	defaultPrefetch    = 10 * time.Minute
+	batchAllowance     = time.Hour // Longest duration of music returned at once by a track source.
+	minSegmentTime     = time.Second
+)
+
+var (
+	ErrInvalidOptions = errors.New("invalid stream options")
+)
+
+// StreamOptions configures a stream, zero fields use the defaults.
+type StreamOptions struct {
+	SegmentTime time.Duration // Target duration of the parts.
+	WindowSize  int           // Number of parts listed in the playlists.
+	Prefetch    time.Duration // Duration of music queued ahead, new tracks are fetched below it.
+	DVRWindow   time.Duration // Duration of played music kept for rewinding, 0 disables the DVR playlists.
+
+	ProxyLess bool
+	Profile   TranscodeProfile
+	Qualities []Quality // Renditions listed in the master playlist, the main one first. Only the main rendition if empty.
+}
+
+func (o StreamOptions) withDefaults() StreamOptions {
+	if o.SegmentTime == 0 {
+		o.SegmentTime = defaultSegmentTime
+	}
+	if o.WindowSize == 0 {
+		o.WindowSize = defaultWindowSize
+	}
+	if o.Prefetch == 0 {
+		o.Prefetch = defaultPrefetch
+	}
+
+	return o
+}
+
+func (o StreamOptions) Validate() error {
+	o = o.withDefaults()
+
+	if o.SegmentTime < minSegmentTime || o.WindowSize < 1 || o.Prefetch < 0 || o.DVRWindow < 0 {
+		return ErrInvalidOptions
+	}
+
+	names := make(map[string]bool)
+	for _, quality := range o.Qualities {
+		if quality.Name == "" || names[quality.Name] || quality.Bandwidth < 0 {
+			return ErrInvalidOptions
+		}
+		names[quality.Name] = true
+	}
+
+	// Transcoded tracks have no alternate renditions.
+	if o.Profile.Transcodes() && len(o.Qualities) > 1 {
+		return ErrInvalidOptions
+	}
+
+	return o.Profile.Validate()
+}
+
+// capacity returns the number of parts the playlists must hold: the window, the prefetched music and a new batch of tracks.
+func (o StreamOptions) capacity() uint {
+	return uint(o.WindowSize) + uint((o.Prefetch+batchAllowance)/o.SegmentTime)
+}
+
+// apply makes the track and its alternate renditions use the options when split.
+func (o StreamOptions) apply(track *Track) {
+	track.segmentTime = o.SegmentTime
+	for _, alternate := range track.alternates {
+		alternate.segmentTime = o.SegmentTime
+	}
+
+	o.Profile.apply(track)
+}
+
+// renditionProfile returns the profile re-encoding the rendition with the given name.
+// Profiles keeping the formats of the tracks re-encode them in AAC, at the bitrate of their quality if known.
+func (o StreamOptions) renditionProfile(name string) TranscodeProfile {
+	if o.Profile.Transcodes() {
+		return o.Profile
+	}
+
+	profile := TranscodeProfile{Codec: CodecAAC, Bitrate: defaultBitrate}
+	for _, quality := range o.Qualities {
+		if quality.Name == name && quality.Bandwidth > 0 {
+			profile.Bitrate = quality.Bandwidth
+		}
+	}
+	return profile
+}
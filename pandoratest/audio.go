@@ -0,0 +1,119 @@
+package pandoratest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	sampleRate      = 44100
+	samplesPerFrame = 1024
+	channels        = 2
+)
+
+var (
+	// Raw AAC-LC frame of stereo silence.
+	silentFrame = []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80}
+	// AudioSpecificConfig: AAC-LC, 44100Hz, stereo.
+	audioSpecificConfig = []byte{0x12, 0x10}
+)
+
+// SilentM4A generates an AAC-in-MP4 file of the given duration, laid out like the files served by Pandora (moov before mdat).
+func SilentM4A(duration time.Duration) []byte {
+	frames := int(duration.Seconds() * sampleRate / samplesPerFrame)
+	if frames < 1 {
+		frames = 1
+	}
+
+	ftyp := box("ftyp", []byte("M4A "), u32(0), []byte("M4A mp42isom"))
+
+	// The moov size doesn't depend on the chunk offset, build it once to know where the samples will start.
+	moov := moovBox(frames, 0)
+	offset := len(ftyp) + len(moov) + 8
+	moov = moovBox(frames, offset)
+
+	mdat := bytes.Repeat(silentFrame, frames)
+
+	return bytes.Join([][]byte{ftyp, moov, box("mdat", mdat)}, nil)
+}
+
+func moovBox(frames int, offset int) []byte {
+	samples := uint32(frames * samplesPerFrame)
+	durationMs := uint32(uint64(samples) * 1000 / sampleRate)
+	matrix := []byte{
+		0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(durationMs),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		matrix, make([]byte, 24), u32(2))
+
+	tkhd := fullBox("tkhd", 0, 7,
+		u32(0), u32(0), u32(1), u32(0), u32(durationMs),
+		make([]byte, 8), u16(0), u16(0), u16(0x0100), u16(0),
+		matrix, u32(0), u32(0))
+
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(sampleRate), u32(samples), u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+
+	esds := fullBox("esds", 0, 0,
+		descriptor(0x03, u16(0), []byte{0},
+			descriptor(0x04, []byte{0x40, 0x15}, []byte{0, 0, 0}, u32(0), u32(0),
+				descriptor(0x05, audioSpecificConfig)),
+			descriptor(0x06, []byte{0x02})))
+	mp4a := box("mp4a",
+		make([]byte, 6), u16(1), make([]byte, 8),
+		u16(channels), u16(16), u16(0), u16(0), u32(sampleRate<<16),
+		esds)
+
+	sizes := make([]byte, 0, frames*4)
+	for i := 0; i < frames; i++ {
+		sizes = append(sizes, u32(uint32(len(silentFrame)))...)
+	}
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), mp4a),
+		fullBox("stts", 0, 0, u32(1), u32(uint32(frames)), u32(samplesPerFrame)),
+		fullBox("stsc", 0, 0, u32(1), u32(1), u32(uint32(frames)), u32(1)),
+		fullBox("stsz", 0, 0, u32(0), u32(uint32(frames)), sizes),
+		fullBox("stco", 0, 0, u32(1), u32(uint32(offset))))
+
+	minf := box("minf",
+		fullBox("smhd", 0, 0, u16(0), u16(0)),
+		box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1))),
+		stbl)
+
+	return box("moov", mvhd, box("trak", tkhd, box("mdia", mdhd, hdlr, minf)))
+}
+
+func box(kind string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	return bytes.Join([][]byte{u32(uint32(len(data) + 8)), []byte(kind), data}, nil)
+}
+
+func fullBox(kind string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(flags)
+	header[0] = version
+	return box(kind, append([][]byte{header}, payload...)...)
+}
+
+func descriptor(tag byte, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	return append([]byte{tag, byte(len(data))}, data...)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,547 @@
+// Package pandoratest provides an in-process fake of the Pandora JSON API, allowing to use the musiko Client and Stream offline.
+//
+// gopiano sends the API calls with an HTTP client of its own, without transport and with no hook to replace it,
+// so the first NewServer of a process wraps http.DefaultTransport. The wrapper only routes the requests of the hosts
+// of the running servers, the other ones go through the original transport. It is never unwrapped.
+package pandoratest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/cellofellow/gopiano"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/blowfish"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pandora API error codes.
+const (
+	CodeInternal           = 0
+	CodeInvalidAuthToken   = 1001
+	CodeInvalidLogin       = 1002
+	CodeStationNotFound    = 1006
+	CodeUsernameTaken      = 1013
+	CodeInvalidPartnerInfo = 1018
+)
+
+const (
+	apiPath   = "/services/json/"
+	audioPath = "/audio/"
+)
+
+var (
+	qualities = []string{"high", "medium", "low"}
+	bitrates  = map[string]int{"high": 192, "medium": 128, "low": 64}
+)
+
+// Server is a fake Pandora API, serving over plain HTTP the calls that gopiano makes over HTTPS.
+// The calls reach it through http.DefaultTransport, see the package documentation. The tracks are downloaded
+// with Client.
+type Server struct {
+	*httptest.Server
+
+	// Number of items returned by each station.getPlaylist call.
+	PlaylistSize int
+	// Duration of the generated audio files.
+	TrackDuration time.Duration
+	// Time taken to serve each audio file.
+	DownloadDelay time.Duration
+
+	description gopiano.ClientDescription
+	host        string
+
+	users         map[string]string // username -> password
+	partnerTokens map[string]bool
+	userTokens    map[string]string // token -> username
+	stations      map[string]string // station id -> music token
+	tracks        map[string]Item   // track token -> item
+	feedbacks     []Feedback
+	calls         map[string]int
+
+	audio        []byte
+	audioLength  time.Duration
+	downloads    int // Audio files being served.
+	maxDownloads int
+	sync.Mutex
+}
+
+// Item is a track returned by station.getPlaylist.
+type Item struct {
+	Token   string
+	Station string
+	Artist  string
+	Album   string
+	Song    string
+}
+
+// Feedback is a thumb up or down received through station.addFeedback.
+type Feedback struct {
+	Station  string
+	Track    string
+	Positive bool
+}
+
+type apiError struct {
+	code    int
+	message string
+}
+
+// NewServer starts a server, wrapping http.DefaultTransport if no server was started before.
+func NewServer() *Server {
+	s := new(Server)
+	s.PlaylistSize = 4
+	s.TrackDuration = 30 * time.Second
+
+	s.users = make(map[string]string)
+	s.partnerTokens = make(map[string]bool)
+	s.userTokens = make(map[string]string)
+	s.stations = make(map[string]string)
+	s.tracks = make(map[string]Item)
+	s.calls = make(map[string]int)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPath, s.apiHandler)
+	mux.HandleFunc(audioPath, s.audioHandler)
+	s.Server = httptest.NewServer(mux)
+
+	s.description = gopiano.AndroidClient
+	s.description.BaseURL = strings.TrimPrefix(s.URL, "http://") + apiPath
+
+	s.host = s.Listener.Addr().String()
+
+	routing.Do(func() {
+		http.DefaultTransport = &router{http.DefaultTransport}
+	})
+	routesLock.Lock()
+	routes[s.host] = s.Transport()
+	routesLock.Unlock()
+
+	return s
+}
+
+// Close shuts the server down and stops routing the requests of its host.
+func (s *Server) Close() {
+	routesLock.Lock()
+	delete(routes, s.host)
+	routesLock.Unlock()
+
+	s.Server.Close()
+}
+
+// Transport returns a transport sending the requests of the server, including the HTTPS ones, to the server.
+func (s *Server) Transport() http.RoundTripper {
+	return &schemeRewriter{s.host, s.Server.Client().Transport}
+}
+
+// Client returns an HTTP client using Transport, to give to the Client and the Stream downloading the tracks.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: s.Transport()}
+}
+
+// Description returns a gopiano client description targeting the server, to use with NewClientWithDescription.
+func (s *Server) Description() gopiano.ClientDescription {
+	return s.description
+}
+
+// AddUser registers an account that can log in with auth.userLogin.
+func (s *Server) AddUser(username, password string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.users[username] = password
+}
+
+// ExpireTokens invalidates every partner and user tokens, the next authenticated call will fail with CodeInvalidAuthToken.
+func (s *Server) ExpireTokens() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.partnerTokens = make(map[string]bool)
+	s.userTokens = make(map[string]string)
+}
+
+// Calls returns the number of times an API method was called, including failed calls.
+func (s *Server) Calls(method string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.calls[method]
+}
+
+// Item returns a track previously served by station.getPlaylist.
+func (s *Server) Item(token string) (Item, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	item, exists := s.tracks[token]
+	return item, exists
+}
+
+// MaxDownloads returns the highest number of audio files served at the same time so far.
+func (s *Server) MaxDownloads() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.maxDownloads
+}
+
+// Feedbacks returns the feedbacks received so far.
+func (s *Server) Feedbacks() []Feedback {
+	s.Lock()
+	defer s.Unlock()
+
+	feedbacks := make([]Feedback, len(s.feedbacks))
+	copy(feedbacks, s.feedbacks)
+	return feedbacks
+}
+
+func (s *Server) apiHandler(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+
+	s.Lock()
+	s.calls[method]++
+	s.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, apiError{CodeInternal, err.Error()})
+		return
+	}
+
+	// Every method but the partner login has an encrypted body.
+	if method != "auth.partnerLogin" {
+		body, err = s.decrypt(body)
+		if err != nil {
+			writeError(w, apiError{CodeInternal, err.Error()})
+			return
+		}
+	}
+
+	request := make(map[string]interface{})
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		writeError(w, apiError{CodeInternal, err.Error()})
+		return
+	}
+
+	var (
+		result interface{}
+		aErr   *apiError
+	)
+
+	s.Lock()
+	switch method {
+	case "auth.partnerLogin":
+		result, aErr = s.partnerLogin(request)
+	case "auth.userLogin":
+		result, aErr = s.userLogin(request)
+	case "user.createUser":
+		result, aErr = s.createUser(request)
+	case "station.createStation":
+		result, aErr = s.createStation(request)
+	case "station.getPlaylist":
+		result, aErr = s.getPlaylist(request)
+	case "station.addFeedback":
+		result, aErr = s.addFeedback(request)
+	default:
+		aErr = &apiError{CodeInternal, fmt.Sprintf("unknown method %s", method)}
+	}
+	s.Unlock()
+
+	if aErr != nil {
+		writeError(w, *aErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat":   "ok",
+		"result": result,
+	})
+}
+
+func writeError(w http.ResponseWriter, err apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat":    "fail",
+		"message": err.message,
+		"code":    err.code,
+	})
+}
+
+func stringField(request map[string]interface{}, name string) string {
+	value, _ := request[name].(string)
+	return value
+}
+
+func (s *Server) checkPartner(request map[string]interface{}) *apiError {
+	if !s.partnerTokens[stringField(request, "partnerAuthToken")] {
+		return &apiError{CodeInvalidAuthToken, "An unexpected error occurred"}
+	}
+	return nil
+}
+
+func (s *Server) checkUser(request map[string]interface{}) *apiError {
+	if _, exists := s.userTokens[stringField(request, "userAuthToken")]; !exists {
+		return &apiError{CodeInvalidAuthToken, "An unexpected error occurred"}
+	}
+	return nil
+}
+
+func (s *Server) partnerLogin(request map[string]interface{}) (interface{}, *apiError) {
+	if stringField(request, "username") != s.description.Username || stringField(request, "password") != s.description.Password {
+		return nil, &apiError{CodeInvalidPartnerInfo, "Invalid partner login"}
+	}
+
+	syncTime, err := s.encrypt([]byte(fmt.Sprintf("sync%d", time.Now().Unix())))
+	if err != nil {
+		return nil, &apiError{CodeInternal, err.Error()}
+	}
+
+	token := uuid.New().String()
+	s.partnerTokens[token] = true
+
+	return map[string]interface{}{
+		"syncTime":         syncTime,
+		"partnerId":        "42",
+		"partnerAuthToken": token,
+		"stationSkipLimit": 6,
+	}, nil
+}
+
+func (s *Server) login(username string) map[string]interface{} {
+	token := uuid.New().String()
+	s.userTokens[token] = username
+
+	return map[string]interface{}{
+		"userId":        username,
+		"userAuthToken": token,
+		"canListen":     true,
+	}
+}
+
+func (s *Server) userLogin(request map[string]interface{}) (interface{}, *apiError) {
+	if err := s.checkPartner(request); err != nil {
+		return nil, err
+	}
+
+	username := stringField(request, "username")
+	password, exists := s.users[username]
+	if !exists || password != stringField(request, "password") {
+		return nil, &apiError{CodeInvalidLogin, "Invalid login"}
+	}
+
+	return s.login(username), nil
+}
+
+func (s *Server) createUser(request map[string]interface{}) (interface{}, *apiError) {
+	if err := s.checkPartner(request); err != nil {
+		return nil, err
+	}
+
+	username := stringField(request, "username")
+	if _, exists := s.users[username]; exists {
+		return nil, &apiError{CodeUsernameTaken, "Username already exists"}
+	}
+	s.users[username] = stringField(request, "password")
+
+	return s.login(username), nil
+}
+
+func (s *Server) createStation(request map[string]interface{}) (interface{}, *apiError) {
+	if err := s.checkUser(request); err != nil {
+		return nil, err
+	}
+
+	musicToken := stringField(request, "musicToken")
+	id := fmt.Sprintf("%d", len(s.stations)+1)
+	s.stations[id] = musicToken
+
+	return map[string]interface{}{
+		"stationId":    id,
+		"stationToken": id,
+		"stationName":  fmt.Sprintf("%s Radio", musicToken),
+	}, nil
+}
+
+func (s *Server) getPlaylist(request map[string]interface{}) (interface{}, *apiError) {
+	if err := s.checkUser(request); err != nil {
+		return nil, err
+	}
+
+	station := stringField(request, "stationToken")
+	if _, exists := s.stations[station]; !exists {
+		return nil, &apiError{CodeStationNotFound, "Station does not exist"}
+	}
+
+	items := make([]map[string]interface{}, s.PlaylistSize)
+	for i := range items {
+		item := Item{
+			Token:   uuid.New().String(),
+			Station: station,
+			Artist:  fmt.Sprintf("Artist %d", len(s.tracks)+1),
+			Album:   fmt.Sprintf("Album %d", len(s.tracks)+1),
+			Song:    fmt.Sprintf("Song %d", len(s.tracks)+1),
+		}
+		s.tracks[item.Token] = item
+
+		audioURLs := make(map[string]interface{})
+		for _, quality := range qualities {
+			audioURLs[fmt.Sprintf("%sQuality", quality)] = map[string]interface{}{
+				"bitrate":  strconv.Itoa(bitrates[quality]),
+				"encoding": "aacplus",
+				"audioUrl": fmt.Sprintf("%s%s%s.m4a?quality=%s", s.URL, audioPath, item.Token, quality),
+				"protocol": "http",
+			}
+		}
+
+		items[i] = map[string]interface{}{
+			"trackToken":  item.Token,
+			"artistName":  item.Artist,
+			"albumName":   item.Album,
+			"songName":    item.Song,
+			"albumArtUrl": fmt.Sprintf("%s/art/%s.jpg", s.URL, item.Token),
+			"trackGain":   "0.00",
+			"audioUrlMap": audioURLs,
+		}
+	}
+
+	return map[string]interface{}{"items": items}, nil
+}
+
+func (s *Server) addFeedback(request map[string]interface{}) (interface{}, *apiError) {
+	if err := s.checkUser(request); err != nil {
+		return nil, err
+	}
+
+	token := stringField(request, "trackToken")
+	if _, exists := s.tracks[token]; !exists {
+		return nil, &apiError{CodeInternal, "Track does not exist"}
+	}
+
+	positive, _ := request["isPositive"].(bool)
+	s.feedbacks = append(s.feedbacks, Feedback{stringField(request, "stationToken"), token, positive})
+
+	return map[string]interface{}{
+		"feedbackId": strconv.Itoa(len(s.feedbacks)),
+		"isPositive": positive,
+	}, nil
+}
+
+func (s *Server) audioHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, audioPath), ".m4a")
+	if _, exists := s.Item(token); !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.Lock()
+	if s.audio == nil || s.audioLength != s.TrackDuration {
+		s.audio = SilentM4A(s.TrackDuration)
+		s.audioLength = s.TrackDuration
+	}
+	audio, delay := s.audio, s.DownloadDelay
+	s.downloads++
+	if s.downloads > s.maxDownloads {
+		s.maxDownloads = s.downloads
+	}
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.downloads--
+		s.Unlock()
+	}()
+
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/mp4")
+	_, _ = w.Write(audio)
+}
+
+// decrypt reverses the blowfish ECB encryption applied by the client with its EncryptKey.
+func (s *Server) decrypt(data []byte) ([]byte, error) {
+	cipher, err := blowfish.NewCipher([]byte(s.description.EncryptKey))
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, hex.DecodedLen(len(data)))
+	_, err = hex.Decode(encrypted, data)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := make([]byte, len(encrypted)-len(encrypted)%blowfish.BlockSize)
+	for i := 0; i < len(decrypted); i += blowfish.BlockSize {
+		cipher.Decrypt(decrypted[i:], encrypted[i:])
+	}
+
+	// Remove the zero padding.
+	return []byte(strings.TrimRight(string(decrypted), "\x00")), nil
+}
+
+// encrypt applies the blowfish ECB encryption that the client reverses with its DecryptKey.
+func (s *Server) encrypt(data []byte) (string, error) {
+	cipher, err := blowfish.NewCipher([]byte(s.description.DecryptKey))
+	if err != nil {
+		return "", err
+	}
+
+	padded := make([]byte, (len(data)+blowfish.BlockSize-1)/blowfish.BlockSize*blowfish.BlockSize)
+	copy(padded, data)
+
+	encrypted := make([]byte, len(padded))
+	for i := 0; i < len(padded); i += blowfish.BlockSize {
+		cipher.Encrypt(encrypted[i:], padded[i:])
+	}
+
+	return hex.EncodeToString(encrypted), nil
+}
+
+var (
+	routes     = make(map[string]http.RoundTripper) // Host of a running server -> its transport.
+	routesLock sync.RWMutex
+	routing    sync.Once // Wraps http.DefaultTransport, the only way to reach the calls of gopiano.
+)
+
+// router sends the requests of the running servers to them, and the other ones to the wrapped transport.
+type router struct {
+	next http.RoundTripper
+}
+
+func (rt *router) RoundTrip(r *http.Request) (*http.Response, error) {
+	routesLock.RLock()
+	transport, exists := routes[r.URL.Host]
+	routesLock.RUnlock()
+
+	if exists {
+		return transport.RoundTrip(r)
+	}
+	return rt.next.RoundTrip(r)
+}
+
+// schemeRewriter serves the HTTPS requests of a server over plain HTTP.
+type schemeRewriter struct {
+	host string
+	next http.RoundTripper
+}
+
+func (sr *schemeRewriter) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == "https" && r.URL.Host == sr.host {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = "http"
+	}
+	return sr.next.RoundTrip(r)
+}
@@ -0,0 +1,48 @@
+package pandoratest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	// The HTTPS calls of gopiano reach the server through the default transport.
+	resp, err := http.Get("https://" + server.host + audioPath + "unknown.m4a")
+	if err != nil {
+		t.Fatalf("https request not routed: %s", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %s, expected the 404 of the server", resp.Status)
+	}
+
+	// The other hosts are left untouched.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("other"))
+	}))
+	defer other.Close()
+
+	resp, err = http.Get(other.URL)
+	if err != nil {
+		t.Fatalf("cannot reach other server: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "other" {
+		t.Errorf("got body %q from other server", body)
+	}
+
+	// Nothing is routed to a closed server.
+	server.Close()
+	routesLock.RLock()
+	_, routed := routes[server.host]
+	routesLock.RUnlock()
+	if routed {
+		t.Errorf("closed server still routed")
+	}
+}
@@ -5,4 +5,8 @@ import "github.com/grafov/m3u8"
 type Part struct {
 	data []byte
 	seg  *m3u8.MediaSegment
+
+	// Segments of the part in the playlist of every rendition of the stream, the first one being seg.
+	renditions []*m3u8.MediaSegment
+	stamped    bool // Listed in the playlists, its segments cannot change anymore.
 }
@@ -0,0 +1,144 @@
+package musiko
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Codecs of the transcode profiles.
+const (
+	CodecAAC = "aac"
+	CodecMP3 = "mp3"
+	// Opus in MPEG-TS is only played by native players such as VLC, mpv or ffplay, not by browsers nor hls.js.
+	CodecOpus = "opus"
+)
+
+const (
+	defaultBitrate = 256000 // Bitrate of the tracks re-encoded without a profile codec.
+)
+
+var (
+	ErrUnknownCodec   = errors.New("unknown transcode codec")
+	ErrInvalidProfile = errors.New("invalid transcode profile")
+)
+
+var (
+	ffmpegEncoders = map[string]string{
+		CodecAAC:  "aac",
+		CodecMP3:  "libmp3lame",
+		CodecOpus: "libopus",
+	}
+	profileCodecs = map[string]string{
+		CodecAAC:  "mp4a.40.2",
+		CodecMP3:  "mp4a.40.34",
+		CodecOpus: "opus",
+	}
+	opusSampleRates = map[int]bool{8000: true, 12000: true, 16000: true, 24000: true, 48000: true}
+)
+
+// TranscodeProfile is the audio format of the parts of a stream.
+// The zero value keeps the tracks as they are when possible, zero fields keep the values of the tracks or the encoder defaults.
+type TranscodeProfile struct {
+	Codec      string
+	Bitrate    int // In bits per second.
+	SampleRate int // In Hz.
+	Channels   int
+
+	Loudness float64 // Target integrated loudness in LUFS, 0 to disable normalization. Tracks needing a gain are re-encoded.
+}
+
+// Transcodes returns true if all the tracks must be transcoded with ffmpeg.
+func (p TranscodeProfile) Transcodes() bool {
+	return p.Codec != ""
+}
+
+// Normalizes returns true if the loudness of the tracks must be normalized.
+func (p TranscodeProfile) Normalizes() bool {
+	return p.Loudness != 0
+}
+
+func (p TranscodeProfile) Validate() error {
+	if p.Normalizes() && (p.Loudness < minLoudness || p.Loudness > 0) {
+		return ErrInvalidProfile
+	}
+
+	if !p.Transcodes() {
+		// Formats cannot be changed without a codec.
+		if p.Bitrate != 0 || p.SampleRate != 0 || p.Channels != 0 {
+			return ErrInvalidProfile
+		}
+		return nil
+	}
+
+	if _, exists := ffmpegEncoders[p.Codec]; !exists {
+		return ErrUnknownCodec
+	}
+
+	if p.Bitrate < 0 || p.SampleRate < 0 || p.Channels < 0 || p.Channels > 2 {
+		return ErrInvalidProfile
+	}
+
+	// Opus only supports a few sample rates.
+	if p.Codec == CodecOpus && p.SampleRate != 0 && !opusSampleRates[p.SampleRate] {
+		return ErrInvalidProfile
+	}
+
+	return nil
+}
+
+// ffmpegArgs returns the ffmpeg codec arguments of the profile, applying a gain in dB if not 0.
+// Tracks are re-encoded in AAC if the profile has no codec.
+func (p TranscodeProfile) ffmpegArgs(gain float64) []string {
+	if !p.Transcodes() {
+		p = TranscodeProfile{Codec: CodecAAC, Bitrate: defaultBitrate}
+	}
+
+	args := []string{"-c:a", ffmpegEncoders[p.Codec]}
+
+	if p.Bitrate > 0 {
+		args = append(args, "-b:a", strconv.Itoa(p.Bitrate))
+	}
+	if p.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(p.SampleRate))
+	} else if p.Codec == CodecOpus {
+		// Tracks are usually sampled at 44.1kHz, which Opus doesn't support.
+		args = append(args, "-ar", "48000")
+	}
+	if p.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(p.Channels))
+	}
+
+	if gain != 0 {
+		filter := fmt.Sprintf("volume=%.2fdB", gain)
+		if gain > 0 {
+			// Avoid clipping the peaks of the amplified tracks.
+			filter += ",alimiter=limit=0.98"
+		}
+		args = append(args, "-af", filter)
+	}
+
+	return args
+}
+
+// codecs returns the RFC 6381 codecs string of the transcoded tracks.
+func (p TranscodeProfile) codecs() string {
+	if !p.Transcodes() {
+		return profileCodecs[CodecAAC]
+	}
+	return profileCodecs[p.Codec]
+}
+
+// apply makes the track use the profile when split.
+func (p TranscodeProfile) apply(track *Track) {
+	if !p.Transcodes() {
+		return
+	}
+
+	track.codec = p.ffmpegArgs(0)
+	track.codecs = p.codecs()
+	track.native = false
+
+	// All the renditions would end up identical.
+	track.alternates = nil
+}
@@ -0,0 +1,30 @@
+package musiko
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenditionProfile(t *testing.T) {
+	normalized := TranscodeProfile{Loudness: -16}
+	transcoded := TranscodeProfile{Codec: CodecMP3, Bitrate: 128000, Loudness: -16}
+
+	tests := []struct {
+		name      string
+		options   StreamOptions
+		rendition string
+		args      string
+	}{
+		{"main", StreamOptions{Profile: normalized}, defaultRendition, "-c:a aac -b:a 256000 -af volume=-3.00dB"},
+		{"quality", StreamOptions{Profile: normalized, Qualities: PandoraQualities}, "medium", "-c:a aac -b:a 128000 -af volume=-3.00dB"},
+		{"unknown quality", StreamOptions{Profile: normalized, Qualities: PandoraQualities}, "lossless", "-c:a aac -b:a 256000 -af volume=-3.00dB"},
+		{"transcoded", StreamOptions{Profile: transcoded, Qualities: PandoraQualities[:1]}, "high", "-c:a libmp3lame -b:a 128000 -af volume=-3.00dB"},
+	}
+
+	for _, test := range tests {
+		args := strings.Join(test.options.renditionProfile(test.rendition).ffmpegArgs(-3), " ")
+		if args != test.args {
+			t.Errorf("%s: got %q, expected %q", test.name, args, test.args)
+		}
+	}
+}
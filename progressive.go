@@ -0,0 +1,186 @@
+package musiko
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	ErrProgressiveUnsupported = errors.New("audio codec cannot be streamed progressively")
+)
+
+// Content types of the audio streams that can be sent without container.
+var audioContentTypes = map[byte]string{
+	tsStreamADTS: "audio/aac",
+	0x03:         "audio/mpeg", // MPEG-1 audio.
+	0x04:         "audio/mpeg", // MPEG-2 audio.
+}
+
+// AudioPart is the audio of a part of the main rendition, without its MPEG-TS container.
+type AudioPart struct {
+	TrackId     string
+	Track       TrackInfo
+	Index       int
+	ContentType string
+	Data        []byte
+}
+
+// ListenAudio calls listener with the audio of each part of the stream when it starts playing, beginning with the current one.
+// Returns when ctx is cancelled, the stream is over, or listener returns an error. Parts are missed by slow listeners.
+func (s *Stream) ListenAudio(ctx context.Context, listener func(AudioPart) error) error {
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	// The current part started before subscribing.
+	if event, ok := s.playingPart(); ok {
+		err := s.sendAudio(event, listener)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return ErrStreamStopped
+			}
+			if event.Type != PartStarted {
+				continue
+			}
+
+			err := s.sendAudio(event, listener)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// playingPart returns the PartStarted event of the current part, if any.
+func (s *Stream) playingPart() (Event, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.current == nil || len(s.queue) == 0 || len(s.queue[0].queue) == 0 || s.queue[0].queue[0] != s.current {
+		return Event{}, false
+	}
+
+	track := s.queue[0]
+	event := trackEvent(PartStarted, track)
+	event.Index = len(track.parts) - len(track.queue)
+	event.Duration = s.current.seg.Duration
+
+	return event, true
+}
+
+func (s *Stream) sendAudio(event Event, listener func(AudioPart) error) error {
+	r, err := s.openPart(event.TrackId, event.Index)
+	if err == ErrPartNotFound {
+		// Skipped in the meantime.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return err
+	}
+
+	audio, contentType, err := tsAudio(data)
+	if err != nil {
+		return err
+	}
+
+	return listener(AudioPart{
+		TrackId:     event.TrackId,
+		Track:       *event.Track,
+		Index:       event.Index,
+		ContentType: contentType,
+		Data:        audio,
+	})
+}
+
+// tsAudio returns the payload of the first audio stream of a TS part and its content type.
+func tsAudio(data []byte) ([]byte, string, error) {
+	if len(data) == 0 || len(data)%tsPacketSize != 0 {
+		return nil, "", ErrInvalidTS
+	}
+
+	var (
+		pmtPID      = -1
+		audioPID    = -1
+		contentType string
+		audio       = new(bytes.Buffer)
+	)
+
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		pid, start, payload := tsPayload(data[offset : offset+tsPacketSize])
+		if payload == nil {
+			continue
+		}
+
+		switch {
+		case pid == tsPATPID && start && pmtPID < 0:
+			section, err := psiPayload(payload)
+			if err != nil || len(section) < 12 {
+				return nil, "", ErrInvalidTS
+			}
+			pmtPID = int(section[10]&0x1F)<<8 | int(section[11])
+		case pid == pmtPID && start && audioPID < 0:
+			section, err := psiPayload(payload)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var streamType byte
+			audioPID, streamType, err = audioStream(section)
+			if err != nil {
+				return nil, "", err
+			}
+
+			var supported bool
+			contentType, supported = audioContentTypes[streamType]
+			if !supported {
+				return nil, "", ErrProgressiveUnsupported
+			}
+		case pid == audioPID && start:
+			// Skip the PES header.
+			if len(payload) < 9 || !bytes.HasPrefix(payload, []byte{0x00, 0x00, 0x01}) || 9+int(payload[8]) > len(payload) {
+				return nil, "", ErrInvalidTS
+			}
+			audio.Write(payload[9+int(payload[8]):])
+		case pid == audioPID:
+			audio.Write(payload)
+		}
+	}
+	if audioPID < 0 {
+		return nil, "", ErrInvalidTS
+	}
+
+	return audio.Bytes(), contentType, nil
+}
+
+// audioStream returns the PID and the type of the first stream of a PMT section, the ID3 metadata one excluded.
+func audioStream(section []byte) (int, byte, error) {
+	infoLength := int(section[10]&0x0F)<<8 | int(section[11])
+	if 12+infoLength > len(section)-4 {
+		return -1, 0, ErrInvalidTS
+	}
+
+	streams := section[12+infoLength : len(section)-4]
+	for i := 0; i+5 <= len(streams); {
+		if streams[i] != tsStreamMetadata {
+			return int(streams[i+1]&0x1F)<<8 | int(streams[i+2]), streams[i], nil
+		}
+		i += 5 + (int(streams[i+3]&0x0F)<<8 | int(streams[i+4]))
+	}
+
+	return -1, 0, ErrInvalidTS
+}
@@ -0,0 +1,211 @@
+package musiko
+
+import (
+	"errors"
+	"github.com/grafov/m3u8"
+	"io"
+	"time"
+)
+
+const (
+	defaultRendition = "main" // Name of the rendition of tracks without quality.
+)
+
+var (
+	ErrRenditionNotFound = errors.New("rendition not found")
+)
+
+// RenditionURIModifier is the PartURIModifier of the alternate renditions.
+type RenditionURIModifier func(string, string, int) string
+
+// MasterURIModifier sets the URIs of the renditions playlists in the master playlist.
+type MasterURIModifier func(string) string
+
+// Quality is a rendition of the stream, listed in the master playlist before any of its parts is published.
+type Quality struct {
+	Name      string // Quality of the tracks played in the rendition.
+	Bandwidth int    // Nominal bitrate in bits per second, replaced by the measured one once parts are published.
+	Codecs    string // Optional, set from the first published part otherwise.
+}
+
+// PandoraQualities are the qualities of the tracks returned by Client.AllQualitiesTracks, the highest first.
+var PandoraQualities = []Quality{
+	{Name: "high", Bandwidth: 192000, Codecs: "mp4a.40.2"},
+	{Name: "medium", Bandwidth: 128000, Codecs: "mp4a.40.2"},
+	{Name: "low", Bandwidth: 64000, Codecs: "mp4a.40.2"},
+}
+
+// rendition is a quality of the stream, with its own playlist kept aligned with the main one.
+type rendition struct {
+	name     string
+	codecs   string
+	target   time.Duration
+	nominal  int // Configured bitrate, used until a part is published.
+	peak     int // Highest bitrate of the full parts.
+	fallback int // Highest bitrate of the short parts, used until a full part is published.
+	playlist *m3u8.MediaPlaylist
+}
+
+// update records the bitrate and codecs of a newly published part.
+func (r *rendition) update(size int, duration float64, codecs string) {
+	if r.codecs == "" {
+		r.codecs = codecs
+	}
+
+	if duration <= 0 {
+		return
+	}
+
+	// The last parts of the tracks can be very short and mostly made of overhead.
+	bitrate := int(float64(size*8) / duration)
+	if duration < r.target.Seconds()/2 {
+		if bitrate > r.fallback {
+			r.fallback = bitrate
+		}
+	} else if bitrate > r.peak {
+		r.peak = bitrate
+	}
+}
+
+func (r *rendition) bandwidth() int {
+	if r.peak > 0 {
+		return r.peak
+	}
+	if r.fallback > 0 {
+		return r.fallback
+	}
+	return r.nominal
+}
+
+// createRenditions creates the renditions of the stream from the configured qualities, the main playlist being the first one.
+// Streams without qualities only have the main rendition.
+func (s *Stream) createRenditions() error {
+	qualities := s.options.Qualities
+	if len(qualities) == 0 {
+		qualities = []Quality{{Name: defaultRendition}}
+	}
+
+	s.renditions = make([]*rendition, 0, len(qualities))
+	for r, quality := range qualities {
+		playlist := s.playlist
+		if r > 0 {
+			var err error
+			playlist, err = m3u8.NewMediaPlaylist(uint(s.options.WindowSize), s.options.capacity())
+			if err != nil {
+				return err
+			}
+			s.continuePlaylist(quality.Name, playlist)
+		}
+
+		s.renditions = append(s.renditions, &rendition{
+			name:     quality.Name,
+			codecs:   quality.Codecs,
+			target:   s.options.SegmentTime,
+			nominal:  quality.Bandwidth,
+			playlist: playlist,
+		})
+	}
+
+	return nil
+}
+
+func renditionName(track *Track) string {
+	if track.quality == "" {
+		return defaultRendition
+	}
+	return track.quality
+}
+
+// alternateIndex returns the index of the alternate rendition with the given name, or -1.
+func (t *Track) alternateIndex(name string) int {
+	for i, alternate := range t.alternates {
+		if renditionName(alternate) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// WriteMasterPlaylist writes a master playlist listing a variant for each rendition of the stream.
+func (s *Stream) WriteMasterPlaylist(writer io.Writer) (int, error) {
+	s.RLock()
+
+	master := m3u8.NewMasterPlaylist()
+	for _, r := range s.renditions {
+		uri := r.name + ".m3u8"
+		if s.MasterURIModifier != nil {
+			uri = s.MasterURIModifier(r.name)
+		}
+
+		master.Append(uri, nil, m3u8.VariantParams{
+			Bandwidth: uint32(r.bandwidth()),
+			Codecs:    r.codecs,
+			Name:      r.name,
+		})
+	}
+
+	// Unlock here to allow long writing.
+	s.RUnlock()
+
+	return writer.Write(master.Encode().Bytes())
+}
+
+// WriteRenditionPlaylist writes the playlist of a rendition, the main one included.
+func (s *Stream) WriteRenditionPlaylist(writer io.Writer, name string) (int, error) {
+	s.RLock()
+
+	var data []byte
+	for _, r := range s.renditions {
+		if r.name == name {
+			// Copy playlist data to a temporary buffer because the writer can be slow.
+			buffer := r.playlist.Encode().Bytes()
+			data = make([]byte, len(buffer))
+			copy(data, buffer)
+			break
+		}
+	}
+
+	s.RUnlock()
+
+	if data == nil {
+		return 0, ErrRenditionNotFound
+	}
+
+	return writer.Write(data)
+}
+
+// WriteRenditionPartData writes a part of an alternate rendition of a track.
+func (s *Stream) WriteRenditionPartData(writer io.Writer, name string, trackId string, index int) (int, error) {
+	s.RLock()
+	track, exists := s.tracks[trackId]
+	if !exists {
+		s.RUnlock()
+		return 0, ErrPartNotFound
+	}
+
+	// The main rendition is also reachable by its name, and plays the main parts of all the tracks.
+	if renditionName(track) == name || name == s.renditions[0].name {
+		s.RUnlock()
+		return s.WritePartData(writer, trackId, index)
+	}
+
+	i := track.alternateIndex(name)
+	if i < 0 || index < 0 || index >= len(track.alternates[i].parts) || track.alternates[i].parts[index] == nil {
+		s.RUnlock()
+		return 0, ErrPartNotFound
+	}
+	alternate := track.alternates[i]
+	s.RUnlock()
+
+	r, err := s.openData(partKey(alternate, index))
+	if err == ErrDataNotFound {
+		return 0, ErrPartNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(writer, r)
+	return int(n), err
+}
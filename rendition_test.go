@@ -0,0 +1,72 @@
+package musiko
+
+import (
+	"bytes"
+	"github.com/grafov/m3u8"
+	"strings"
+	"testing"
+)
+
+func TestStreamRenditions(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{Qualities: PandoraQualities}, nil)
+
+	buffer := new(bytes.Buffer)
+	_, err := stream.WriteMasterPlaylist(buffer)
+	if err != nil {
+		t.Fatalf("cannot write master playlist: %s", err)
+	}
+	playlist, listType, err := m3u8.DecodeFrom(buffer, true)
+	if err != nil || listType != m3u8.MASTER {
+		t.Fatalf("invalid master playlist: %v", err)
+	}
+
+	variants := playlist.(*m3u8.MasterPlaylist).Variants
+	if len(variants) != len(PandoraQualities) {
+		t.Fatalf("got %d variants, expected %d", len(variants), len(PandoraQualities))
+	}
+	for i, variant := range variants {
+		if variant.Name != PandoraQualities[i].Name || variant.Bandwidth == 0 || variant.Codecs == "" {
+			t.Errorf("invalid variant %+v", variant.VariantParams)
+		}
+	}
+
+	for _, quality := range PandoraQualities {
+		buffer.Reset()
+		_, err := stream.WriteRenditionPlaylist(buffer, quality.Name)
+		if err != nil {
+			t.Fatalf("cannot write %s playlist: %s", quality.Name, err)
+		}
+		if !strings.Contains(buffer.String(), "#EXTINF") {
+			t.Errorf("%s playlist has no parts", quality.Name)
+		}
+	}
+
+	_, err = stream.WriteRenditionPlaylist(buffer, "unknown")
+	if err != ErrRenditionNotFound {
+		t.Errorf("got %v, expected %v", err, ErrRenditionNotFound)
+	}
+}
+
+func TestStreamOptionsQualities(t *testing.T) {
+	tests := []struct {
+		name    string
+		options StreamOptions
+		valid   bool
+	}{
+		{"none", StreamOptions{}, true},
+		{"pandora", StreamOptions{Qualities: PandoraQualities}, true},
+		{"unnamed", StreamOptions{Qualities: []Quality{{Bandwidth: 1000}}}, false},
+		{"duplicate", StreamOptions{Qualities: []Quality{{Name: "high"}, {Name: "high"}}}, false},
+		{"negative bandwidth", StreamOptions{Qualities: []Quality{{Name: "high", Bandwidth: -1}}}, false},
+		{"transcoded", StreamOptions{Qualities: PandoraQualities, Profile: TranscodeProfile{Codec: CodecMP3}}, false},
+		{"transcoded main", StreamOptions{Qualities: PandoraQualities[:1], Profile: TranscodeProfile{Codec: CodecMP3}}, true},
+	}
+
+	for _, test := range tests {
+		err := test.options.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package musiko
+
+import "net/http"
+
+// TrackSource provides the next batch of tracks to a Stream.
+type TrackSource interface {
+	NextTracks(station string, httpClient *http.Client) ([]*Track, error)
+}
+
+// FeedbackSource is implemented by the sources that can be steered with thumbs up and down.
+type FeedbackSource interface {
+	Feedback(station string, track *Track, positive bool) error
+}
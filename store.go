@@ -0,0 +1,223 @@
+package musiko
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrStoreFull    = errors.New("store budget exceeded")
+	ErrDataNotFound = errors.New("data not found in store")
+)
+
+// PartStore keeps the data of the parts and tracks while they are available in a stream.
+// Keys are unique across streams, so a single store can be shared by multiple streams.
+type PartStore interface {
+	Put(key string, data []byte) error
+	Open(key string) (io.ReadCloser, error)
+	Remove(key string) error
+}
+
+// NewMemoryStore creates a store keeping the data in memory. A limit of 0 means no limit.
+func NewMemoryStore(limit int64) *MemoryStore {
+	s := new(MemoryStore)
+	s.limit = limit
+	s.data = make(map[string][]byte)
+
+	return s
+}
+
+type MemoryStore struct {
+	limit int64
+	used  int64
+	data  map[string][]byte
+	sync.RWMutex
+}
+
+func (s *MemoryStore) Put(key string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	size := int64(len(data))
+	if old, exists := s.data[key]; exists {
+		size -= int64(len(old))
+	}
+
+	if s.limit > 0 && s.used+size > s.limit {
+		return ErrStoreFull
+	}
+
+	s.data[key] = data
+	s.used += size
+
+	return nil
+}
+
+func (s *MemoryStore) Open(key string) (io.ReadCloser, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	// Because we never alter the data we don't need to make a copy before reading.
+	data, exists := s.data[key]
+	if !exists {
+		return nil, ErrDataNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStore) Remove(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	data, exists := s.data[key]
+	if !exists {
+		return ErrDataNotFound
+	}
+
+	delete(s.data, key)
+	s.used -= int64(len(data))
+
+	return nil
+}
+
+// Used returns the number of bytes kept in memory.
+func (s *MemoryStore) Used() int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.used
+}
+
+const (
+	diskStoreExt = ".part"
+)
+
+// NewDiskStore creates a store writing the data as files in dir, creating it if needed.
+// The files left in dir by a previous store are removed.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// Temporary files are matched too.
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*"+diskStoreExt+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	s := new(DiskStore)
+	s.dir = dir
+
+	return s, nil
+}
+
+type DiskStore struct {
+	dir string
+}
+
+func (s *DiskStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key)+diskStoreExt)
+}
+
+func (s *DiskStore) Put(key string, data []byte) error {
+	// Write to a temporary file first so readers never see a partial file.
+	tmp := s.path(key) + ".tmp"
+
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path(key))
+}
+
+func (s *DiskStore) Open(key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrDataNotFound
+	}
+
+	return file, err
+}
+
+func (s *DiskStore) Remove(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return ErrDataNotFound
+	}
+
+	return err
+}
+
+// NewBudgetStore creates a store keeping the data in memory up to budget bytes, and writing the rest in dir.
+func NewBudgetStore(budget int64, dir string) (*BudgetStore, error) {
+	disk, err := NewDiskStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(BudgetStore)
+	s.memory = NewMemoryStore(budget)
+	s.disk = disk
+
+	return s, nil
+}
+
+type BudgetStore struct {
+	memory *MemoryStore
+	disk   *DiskStore
+}
+
+func (s *BudgetStore) Put(key string, data []byte) error {
+	err := s.memory.Put(key, data)
+	if err == nil {
+		// Drop a previous version written to disk.
+		err = s.disk.Remove(key)
+		if err == ErrDataNotFound {
+			return nil
+		}
+		return err
+	}
+	if err != ErrStoreFull {
+		return err
+	}
+
+	// A previous version kept in memory would be read instead, and use the budget.
+	err = s.memory.Remove(key)
+	if err != nil && err != ErrDataNotFound {
+		return err
+	}
+
+	return s.disk.Put(key, data)
+}
+
+func (s *BudgetStore) Open(key string) (io.ReadCloser, error) {
+	r, err := s.memory.Open(key)
+	if err != ErrDataNotFound {
+		return r, err
+	}
+
+	return s.disk.Open(key)
+}
+
+func (s *BudgetStore) Remove(key string) error {
+	err := s.memory.Remove(key)
+	if err != ErrDataNotFound {
+		return err
+	}
+
+	return s.disk.Remove(key)
+}
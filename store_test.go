@@ -0,0 +1,85 @@
+package musiko
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func readStore(t *testing.T, store PartStore, key string) string {
+	t.Helper()
+
+	r, err := store.Open(key)
+	if err != nil {
+		t.Fatalf("cannot open %s: %s", key, err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("cannot read %s: %s", key, err)
+	}
+	return string(data)
+}
+
+func TestBudgetStoreReplace(t *testing.T) {
+	store, err := NewBudgetStore(8, t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create store: %s", err)
+	}
+
+	// Kept in memory, then replaced by data too big for the budget.
+	_ = store.Put("key", []byte("small"))
+	err = store.Put("key", []byte("too big for memory"))
+	if err != nil {
+		t.Fatalf("cannot replace data: %s", err)
+	}
+	if data := readStore(t, store, "key"); data != "too big for memory" {
+		t.Errorf("got %q after replacing it", data)
+	}
+	if used := store.memory.Used(); used != 0 {
+		t.Errorf("stale data still uses %d bytes of the budget", used)
+	}
+
+	// Back in memory.
+	err = store.Put("key", []byte("small"))
+	if err != nil {
+		t.Fatalf("cannot replace data: %s", err)
+	}
+	if data := readStore(t, store, "key"); data != "small" {
+		t.Errorf("got %q after replacing it", data)
+	}
+	if _, err := store.disk.Open("key"); err != ErrDataNotFound {
+		t.Errorf("stale data still on disk: %v", err)
+	}
+
+	err = store.Remove("key")
+	if err != nil {
+		t.Fatalf("cannot remove data: %s", err)
+	}
+	if _, err := store.Open("key"); err != ErrDataNotFound {
+		t.Errorf("data still readable after removal: %v", err)
+	}
+}
+
+func TestDiskStoreLeftovers(t *testing.T) {
+	dir := t.TempDir()
+
+	previous, _ := NewDiskStore(dir)
+	_ = previous.Put("part", []byte("data"))
+	_ = ioutil.WriteFile(filepath.Join(dir, "part"+diskStoreExt+".tmp"), []byte("partial"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "history.json"), []byte("{}"), 0600)
+
+	store, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("cannot create store: %s", err)
+	}
+	if _, err := store.Open("part"); err != ErrDataNotFound {
+		t.Errorf("data of the previous store still readable: %v", err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "history.json" {
+		t.Errorf("got files %v, expected only the ones of other programs", files)
+	}
+}
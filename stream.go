@@ -1,8 +1,10 @@
 package musiko
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/grafov/m3u8"
 	"io"
@@ -14,9 +16,8 @@ import (
 )
 
 const (
-	playlistCapacity = 256     // About 10 songs.
-	playlistSize     = 6       // About 60 sec of music.
-	fetchLimit       = 10 * 60 // 10 min of music.
+	partsBuffer = 64 // Parts split ahead of the publication of their track.
+	splitAhead  = 1  // Tracks downloaded and split ahead of the one being published.
 )
 
 // Stream state.
@@ -27,35 +28,51 @@ const (
 	killed
 )
 
+var stateNames = []string{"stopped", "running", "paused", "killed"}
+
 var (
 	ErrStreamAlreadyStarted = errors.New("stream cannot be started")
+	ErrStreamStopped        = errors.New("stream stopped")
 	ErrStreamNotRunning     = errors.New("stream not running")
 	ErrStreamNotPaused      = errors.New("stream not paused")
+	ErrNoNextTrack          = errors.New("no next track to skip to")
 	ErrPlaylistEmpty        = errors.New("the playlist is empty")
 	ErrTrackNotClear        = errors.New("track not properly cleared")
 	ErrTrackNotFound        = errors.New("track not found")
 	ErrPartNotFound         = errors.New("part not found")
+	ErrFeedbackUnsupported  = errors.New("track source does not support feedback")
 )
 
 type PartURIModifier func(string, int) string
 
-func NewStream(client *Client, station string, proxyLess bool) (*Stream, error) {
+func NewStream(source TrackSource, station string, options StreamOptions) (*Stream, error) {
+	err := options.Validate()
+	if err != nil {
+		return nil, err
+	}
+	options = options.withDefaults()
+
 	stream := new(Stream)
 
-	playlist, err := m3u8.NewMediaPlaylist(playlistSize, playlistCapacity)
+	playlist, err := m3u8.NewMediaPlaylist(uint(options.WindowSize), options.capacity())
 	if err != nil {
 		return nil, err
 	}
 
 	stream.id = uuid.New()
 	stream.station = station
-	stream.client = client
+	stream.source = source
+	stream.options = options
 	stream.playlist = playlist
 
+	stream.done = make(chan struct{})
 	stream.queue = make([]*Track, 0)
 	stream.tracks = make(map[string]*Track)
+	stream.Store = NewMemoryStore(0)
+	stream.subscribers = make(map[<-chan Event]*subscriber)
+	stream.renderBridge = ffmpegBridge
 
-	if proxyLess {
+	if options.ProxyLess {
 		stream.httpClient = httpClientNoProxy()
 	} else {
 		stream.httpClient = http.DefaultClient
@@ -87,231 +104,865 @@ type Stream struct {
 	station string
 
 	httpClient *http.Client
-	client     *Client
-
-	errChan    chan<- error
+	source     TrackSource
+	options    StreamOptions
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	err        error
+	routines   sync.WaitGroup
 	pauseChan  chan struct{}
 	resumeChan chan struct{}
+	skipChan   chan struct{}
+
+	published chan struct{}
+
+	subscribers     map[<-chan Event]*subscriber
+	subscribersLock sync.Mutex
 
 	available float64
 	queue     []*Track
 	tracks    map[string]*Track
 	playlist  *m3u8.MediaPlaylist
 
-	URIModifier PartURIModifier
+	current      *Part // Part being played, the first one of the head track.
+	currentStart time.Time
+	pausedAt     time.Time
+
+	renditions []*rendition
+
+	tail         *pendingPart
+	renderBridge bridgeRenderer
+	rangeEnds    []*dateRange // Ends of the date ranges already listed, added to the next listed part.
+
+	starts map[string]sequence // Where the playlists of the stream continued from.
+	ends   map[string]sequence // Where the next stream should continue from, once over.
+
+	retired []retiredTrack // Removed tracks whose data is still served, oldest first.
+
+	dvr         []dvrPart // Played parts kept for rewinding, oldest first.
+	dvrDuration float64
+
+	URIModifier          PartURIModifier
+	RenditionURIModifier RenditionURIModifier
+	MasterURIModifier    MasterURIModifier
+	DASHURIModifier      DASHURIModifier
+	Store                PartStore     // Must be set before starting the stream.
+	Crossfade            time.Duration // Requires ffmpeg, must be set before starting the stream.
+	History              *History      // Records the played tracks, may be shared by multiple streams.
+	Name                 string        // Name of the station recorded in the history, the station id if empty.
+	DVRStore             PartStore     // Receives the played parts of the DVR window, the Store is used if nil. Must be set before starting the stream.
 
 	fetching bool
 	sync.RWMutex
 }
 
-func (s *Stream) Start(report chan<- error) error {
+// Start fetches the first tracks and starts the stream, which runs until ctx is cancelled, Stop is called or an error occurs.
+func (s *Stream) Start(ctx context.Context) error {
 	if s.state != stopped {
 		return ErrStreamAlreadyStarted
 	}
 
+	// The playlists are continued by Continue before starting.
+	s.Lock()
+	err := s.createRenditions()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Starting stream (%s).\n", s.id.String())
 
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.pauseChan = make(chan struct{})
+	s.resumeChan = make(chan struct{})
+	s.skipChan = make(chan struct{})
+	s.published = make(chan struct{}, 1)
+	s.state = running
+
+	// Count the queue loop now so the supervisor never waits on an empty group.
+	s.routines.Add(1)
+
+	var (
+		ready  chan struct{}
+		result <-chan error
+	)
 	if s.shouldFetchPlaylist() {
-		err := s.queueNextPlaylist()
-		if err != nil {
-			return err
-		}
+		ready = make(chan struct{})
+		result = s.startFetch(ready)
 	}
 
-	s.errChan = report
-	s.pauseChan = make(chan struct{})
-	s.resumeChan = make(chan struct{})
+	go s.supervise()
+
+	// Start playing as soon as the first part is published.
+	if result != nil {
+		select {
+		case <-ready:
+			go s.watchFetch(result)
+		case err := <-result:
+			if err != nil {
+				s.routines.Done()
+				s.fail(err)
+				<-s.done
+				return err
+			}
+		case <-s.ctx.Done():
+			s.routines.Done()
+			<-s.done
+			return s.Err()
+		}
+	}
 
 	go s.queueLoop()
-	s.state = running
 
 	log.Printf("Stream started (%s).\n", s.id.String())
 	return nil
 }
 
+// Stop cancels the stream and waits for its fetches to end and its tracks to be released.
+func (s *Stream) Stop() error {
+	if s.state == stopped {
+		return ErrStreamNotRunning
+	}
+
+	s.fail(ErrStreamStopped)
+	<-s.done
+
+	return nil
+}
+
+// Done returns a channel closed once the stream is over and its tracks are released.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that ended the stream, ErrStreamStopped if Stop was called, or nil while it is running.
+func (s *Stream) Err() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.err
+}
+
+// State returns the state of the stream: "stopped", "running", "paused" or "killed".
+func (s *Stream) State() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return stateNames[s.state]
+}
+
+// fail records the error ending the stream, if it is the first one, and cancels the stream.
+func (s *Stream) fail(err error) {
+	s.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.Unlock()
+
+	s.cancel()
+}
+
+// supervise waits for the cancellation of the stream, then for its routines, and releases the tracks.
+func (s *Stream) supervise() {
+	<-s.ctx.Done()
+
+	// Cancelled by the parent context.
+	s.fail(s.ctx.Err())
+	s.routines.Wait()
+
+	s.Lock()
+	s.recordEnds()
+	for len(s.queue) > 0 {
+		s.removeTrack(s.queue[0])
+	}
+	s.releaseTracks(true)
+	for len(s.dvr) > 0 {
+		s.dropPart()
+	}
+	s.tail = nil
+	s.state = killed
+	err := s.err
+	s.Unlock()
+
+	close(s.done)
+	s.emit(Event{Type: Killed, Err: err})
+	log.Printf("Stream ended: %s (%s).\n", err.Error(), s.id.String())
+}
+
 func (s *Stream) Pause() error {
-	if s.state != running {
+	s.RLock()
+	state := s.state
+	s.RUnlock()
+	if state != running {
 		return ErrStreamNotRunning
 	}
 
-	s.pauseChan <- struct{}{}
-	s.state = paused
+	select {
+	case s.pauseChan <- struct{}{}:
+	case <-s.ctx.Done():
+		return ErrStreamNotRunning
+	}
+
+	// The stream may have ended in the meantime.
+	s.Lock()
+	changed := s.state == running
+	if changed {
+		s.state = paused
+		s.pausedAt = time.Now()
+	}
+	s.Unlock()
+	if !changed {
+		return ErrStreamNotRunning
+	}
+	s.emit(Event{Type: Paused})
 
 	log.Printf("Stream paused (%s).\n", s.id.String())
 	return nil
 }
 
 func (s *Stream) Resume() error {
-	if s.state != paused {
+	s.RLock()
+	state := s.state
+	s.RUnlock()
+	if state != paused {
 		return ErrStreamNotPaused
 	}
 
-	s.resumeChan <- struct{}{}
-	s.state = running
+	select {
+	case s.resumeChan <- struct{}{}:
+	case <-s.ctx.Done():
+		return ErrStreamNotRunning
+	}
+
+	s.Lock()
+	changed := s.state == paused
+	if changed {
+		s.state = running
+	}
+	s.Unlock()
+	if !changed {
+		return ErrStreamNotRunning
+	}
+	s.emit(Event{Type: Resumed})
 
 	log.Printf("Stream resumed (%s).\n", s.id.String())
 	return nil
 }
 
+// Skip drops the remaining parts of the current track and jumps to the next one.
+func (s *Stream) Skip() error {
+	s.RLock()
+	state := s.state
+	remaining := len(s.queue)
+	s.RUnlock()
+
+	if state != running {
+		return ErrStreamNotRunning
+	}
+
+	// Keep at least one track in the playlist while the next ones are fetched.
+	if remaining < 2 {
+		return ErrNoNextTrack
+	}
+
+	select {
+	case s.skipChan <- struct{}{}:
+	case <-s.ctx.Done():
+		return ErrStreamNotRunning
+	}
+
+	log.Printf("Track skipped (%s).\n", s.id.String())
+	return nil
+}
+
 func (s *Stream) shouldFetchPlaylist() bool {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.available <= fetchLimit && !s.fetching
+	return s.available <= s.options.Prefetch.Seconds() && !s.fetching
 }
 
-func (s *Stream) queueNextPlaylist() error {
+// startFetch queues the next playlist in the background. If not nil, ready is closed once the first part is published.
+func (s *Stream) startFetch(ready chan<- struct{}) <-chan error {
 	s.Lock()
 	s.fetching = true
 	s.Unlock()
 
-	// Unlock fetching on exit.
+	result := make(chan error, 1)
+	s.routines.Add(1)
+	go func() {
+		defer s.routines.Done()
+
+		s.emit(Event{Type: FetchStarted})
+		err := s.queueNextPlaylist(ready)
+		if err != nil && s.ctx.Err() == nil {
+			s.emit(Event{Type: FetchFailed, Err: err})
+		}
+		result <- err
+	}()
+
+	return result
+}
+
+// watchFetch ends the stream if the fetch fails.
+func (s *Stream) watchFetch(result <-chan error) {
+	err := <-result
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *Stream) queueNextPlaylist(ready chan<- struct{}) error {
+	// Unlock fetching on exit, and wake up the queue loop if it is waiting for parts.
 	defer func() {
 		s.Lock()
 		s.fetching = false
 		s.Unlock()
+		s.notifyPublished()
 	}()
 
 	log.Printf("Queuing a new playlist (%s).\n", s.id.String())
 
-	tracks, err := s.client.HighQualityTracks(s.station, s.httpClient)
+	tracks, err := s.source.NextTracks(s.station, s.httpClient)
 	if err != nil {
 		return err
 	}
 
+	// Download and split the next tracks while publishing one, but publish them in order so their parts don't interleave.
 	var (
-		wg        sync.WaitGroup
-		errCommon error
+		outputs    = make([]<-chan *Part, len(tracks))
+		alternates = make([][]<-chan *Part, len(tracks))
+		results    = make([]<-chan error, len(tracks))
+		errCommon  error
 	)
-	wg.Add(len(tracks))
 
-	for _, t := range tracks {
-		go func(track *Track) {
-			defer wg.Done()
+	split := func(i int) {
+		if i >= len(tracks) || outputs[i] != nil || errCommon != nil {
+			return
+		}
+		tracks[i].setContext(s.ctx)
+		s.options.apply(tracks[i])
+		outputs[i], alternates[i], results[i] = s.splitTrack(tracks[i])
+	}
+	for i := 0; i <= splitAhead; i++ {
+		split(i)
+	}
+
+	publish := func(pending *pendingPart) {
+		// Stop publishing once the stream is cancelled, the tracks are drained and released.
+		if errCommon == nil {
+			errCommon = s.ctx.Err()
+		}
+		if errCommon == nil {
+			errCommon = s.publishPart(pending.track, pending.part, pending.alternates, pending.index)
+		}
+
+		if ready != nil {
+			close(ready)
+			ready = nil
+		}
+	}
+
+	// The tracks are not split anymore after an error.
+	for i := 0; i < len(tracks) && outputs[i] != nil; i++ {
+		track := tracks[i]
+		split(i + splitAhead)
+
+		var (
+			index   = 0
+			held    *pendingPart
+			bridged bool
+		)
+		for part := range outputs[i] {
+			// Alternate parts are nil if their rendition ended early or failed.
+			alternateParts := make([]*Part, len(alternates[i]))
+			for j, alternate := range alternates[i] {
+				alternateParts[j] = <-alternate
+			}
 
-			playlist, _, err := track.GetParts()
+			pending := &pendingPart{track, part, alternateParts, index}
+			index++
+
+			// Mix the first part with the tail of the previous track.
+			if pending.index == 0 && s.tail != nil {
+				pending, bridged = s.crossfade(s.tail, pending, publish)
+				index = pending.index + 1
+				s.tail = nil
+			} else if bridged {
+				// The bridge has its own timestamps.
+				pending.part.seg.Discontinuity = true
+				bridged = false
+			}
+
+			// Hold back the last part of the track to crossfade it with the next track.
+			if s.Crossfade > 0 {
+				if held != nil {
+					publish(held)
+				}
+				held = pending
+			} else {
+				publish(pending)
+			}
+		}
+
+		// Drop the extra parts of the alternate renditions.
+		for _, alternate := range alternates[i] {
+			for range alternate {
+			}
+		}
+
+		err = <-results[i]
+		if err != nil && errCommon == nil {
+			errCommon = err
+		}
+
+		// The track is completed once its tail is published.
+		if held != nil && held.index > 0 && errCommon == nil {
+			s.tail = held
+		} else {
+			if held != nil {
+				publish(held)
+			}
+			s.completeTrack(track)
+		}
+
+		if index > 0 {
+			log.Printf("Track added to main playlist (%s).\n", track.id.String())
+		}
+	}
+
+	s.RLock()
+	log.Printf("New playlist queued. Total duration: %.2fs (%s).\n", s.available, s.id.String())
+	s.RUnlock()
+
+	return errCommon
+}
+
+// splitTrack downloads, normalizes and splits a track and its alternate renditions in the background.
+// Alternate renditions are cut on the boundaries of the main one, and produce at most as many parts.
+func (s *Stream) splitTrack(track *Track) (<-chan *Part, []<-chan *Part, <-chan error) {
+	var (
+		output     = make(chan *Part, partsBuffer)
+		alternates = make([]<-chan *Part, len(track.alternates))
+		boundaries = make([]chan float64, len(track.alternates))
+		result     = make(chan error, 1)
+
+		// Normalization may change the codec of the alternate renditions.
+		normalized = make(chan struct{})
+	)
+
+	for i, alternate := range track.alternates {
+		alternateOutput := make(chan *Part, partsBuffer)
+		alternates[i] = alternateOutput
+		boundaries[i] = make(chan float64, partsBuffer)
+
+		go func(alternate *Track, boundaries <-chan float64, output chan<- *Part) {
+			defer close(output)
+
+			<-normalized
+			err := alternate.StreamAlignedParts(boundaries, func(part *Part) {
+				output <- part
+			})
 			if err != nil {
-				errCommon = err
-				return
+				log.Printf("Cannot split alternate rendition, using main one: %s (%s).\n", err.Error(), alternate.id.String())
 			}
 
+			// Never block the main rendition.
+			for range boundaries {
+			}
+		}(alternate, boundaries[i], alternateOutput)
+	}
+
+	go func() {
+		defer close(output)
+
+		s.normalize(track)
+		close(normalized)
+
+		var end float64
+		err := track.StreamParts(func(part *Part) {
+			end += part.seg.Duration
+			for _, b := range boundaries {
+				b <- end
+			}
+
+			output <- part
+		})
+
+		for _, b := range boundaries {
+			close(b)
+		}
+
+		if err == nil {
 			log.Printf("Track fetched and split (%s).\n", track.id.String())
+		}
+		result <- err
+	}()
 
-			s.Lock()
-			defer s.Unlock()
+	return output, alternates, result
+}
 
-			s.queue = append(s.queue, track)
-			s.tracks[track.id.String()] = track
+// publishPart appends a part to the main playlist, and the parts of the alternate renditions to their playlists,
+// making them available to the players and the queue loop.
+func (s *Stream) publishPart(track *Track, part *Part, alternates []*Part, index int) error {
+	// Players without the web player read the info of the track from its first part.
+	part.data = tagPart(track, part.data, index)
+	for _, alternate := range alternates {
+		if alternate != nil {
+			alternate.data = tagPart(track, alternate.data, index)
+		}
+	}
 
-			for i, seg := range playlist.Segments {
-				if seg == nil {
-					break
-				}
+	var dash *dashConfig
+	if index == 0 {
+		dash = newDASHConfig(part.data, track.codecs)
+	}
 
-				// Increment total duration by segment duration.
-				s.available += seg.Duration
+	mainSize := len(part.data)
+	err := s.Store.Put(partKey(track, index), part.data)
+	if err != nil {
+		return err
+	}
+	part.data = nil
 
-				// Apply URI modifier if required.
-				if s.URIModifier != nil {
-					seg.URI = s.URIModifier(track.id.String(), i)
-				}
+	sizes := make([]int, len(alternates))
+	for i, alternate := range alternates {
+		if alternate == nil {
+			continue
+		}
 
-				err := s.playlist.AppendSegment(seg)
-				if err != nil {
-					errCommon = err
-					return
-				}
+		sizes[i] = len(alternate.data)
+		err = s.Store.Put(partKey(track.alternates[i], index), alternate.data)
+		if err != nil {
+			return err
+		}
+		alternate.data = nil
+	}
 
-				// Set Discontinuity tag for the first part.
-				if i == 0 {
-					err = s.playlist.SetDiscontinuity()
-					if err != nil {
-						errCommon = err
-						return
-					}
-				}
+	s.Lock()
+	defer s.Unlock()
+
+	if index == 0 {
+		track.dash = dash
+		s.queue = append(s.queue, track)
+		s.tracks[track.id.String()] = track
+		s.emit(trackEvent(TrackQueued, track))
+	}
+
+	track.parts = append(track.parts, part)
+	track.queue = append(track.queue, part)
+	for i, alternate := range track.alternates {
+		alternate.parts = append(alternate.parts, alternates[i])
+	}
+
+	// Increment total duration by segment duration.
+	s.available += part.seg.Duration
+
+	// Apply URI modifier if required.
+	if s.URIModifier != nil {
+		part.seg.URI = s.URIModifier(track.id.String(), index)
+	}
+
+	// Use the main part in renditions missing from the track.
+	part.renditions = make([]*m3u8.MediaSegment, len(s.renditions))
+	for r, rendition := range s.renditions {
+		seg, size, codecs := part.seg, mainSize, track.codecs
+
+		i := track.alternateIndex(rendition.name)
+		if r > 0 && i >= 0 && alternates[i] != nil {
+			seg, size, codecs = alternates[i].seg, sizes[i], track.alternates[i].codecs
+
+			if s.RenditionURIModifier != nil {
+				seg.URI = s.RenditionURIModifier(rendition.name, track.id.String(), index)
 			}
+		}
 
-			log.Printf("Track added to main playlist (%s).\n", track.id.String())
-		}(t)
+		// Advertise the track in the playlists too.
+		if index == 0 {
+			seg.Title = trackTitle(track.info)
+		}
+
+		part.renditions[r] = seg
+		rendition.update(size, seg.Duration, codecs)
+
+		err = rendition.playlist.AppendSegment(seg)
+		if err != nil {
+			return err
+		}
+
+		// Set Discontinuity tag for the first part, and the part following a crossfade.
+		if index == 0 || part.seg.Discontinuity {
+			err = rendition.playlist.SetDiscontinuity()
+			if err != nil {
+				return err
+			}
+		}
 	}
+	s.stamp()
 
-	wg.Wait()
+	event := trackEvent(SegmentPublished, track)
+	event.Index = index
+	event.Duration = part.seg.Duration
+	s.emit(event)
 
-	log.Printf("New playlist queued. Total duration: %.2fs (%s).\n", s.available, s.id.String())
-	return errCommon
+	s.notifyPublished()
+	return nil
+}
+
+// completeTrack marks a track as fully published, removing it if all its parts were already played.
+func (s *Stream) completeTrack(track *Track) {
+	// Local tracks are read from disk when downloaded, only keep the remote ones.
+	// Tracks cancelled before their first part are never queued, so never released.
+	if track.path == "" && track.data != nil && len(track.parts) > 0 {
+		err := s.Store.Put(track.id.String(), track.data)
+		if err != nil {
+			log.Printf("Cannot store track data: %s (%s).\n", err.Error(), track.id.String())
+		}
+	}
+	track.ClearData()
+
+	s.Lock()
+	defer s.Unlock()
+
+	track.complete = true
+	s.endDateRange(track)
+	if len(track.parts) > 0 && len(track.queue) == 0 && len(s.queue) > 0 && s.queue[0] == track {
+		s.finishTrack(track)
+	}
+}
+
+// finishTrack removes the head track once all its parts were played.
+func (s *Stream) finishTrack(track *Track) {
+	s.emit(trackEvent(TrackFinished, track))
+
+	if s.History != nil {
+		track.archived = true
+
+		name := s.Name
+		if name == "" {
+			name = s.station
+		}
+		s.History.add(name, track, s.Store)
+	}
+	s.removeTrack(track)
+}
+
+// removeTrack removes the head track from the queue, and retires its data until the end of the grace period.
+// The parts kept for rewinding are released with the DVR window.
+func (s *Stream) removeTrack(track *Track) {
+	s.queue = s.queue[1:]
+
+	var keys []string
+	if !track.archived {
+		keys = append(keys, track.id.String())
+	}
+
+	// The parts kept for rewinding are released by the DVR window.
+	for i := track.kept; i < len(track.parts); i++ {
+		keys = append(keys, partKeys(track, i)...)
+	}
+
+	s.retired = append(s.retired, retiredTrack{track, keys, time.Now().Add(s.gracePeriod())})
+}
+
+// gracePeriod returns how long the removed parts stay available to the players that loaded an older playlist.
+func (s *Stream) gracePeriod() time.Duration {
+	return s.options.SegmentTime * time.Duration(s.options.WindowSize)
+}
+
+// releaseTracks removes the retired tracks from the map and releases their data once their grace period is over, or right away if all.
+// Must be called with the stream locked.
+func (s *Stream) releaseTracks(all bool) {
+	now := time.Now()
+	for len(s.retired) > 0 && (all || !now.Before(s.retired[0].expires)) {
+		retired := s.retired[0]
+		s.retired[0] = retiredTrack{}
+		s.retired = s.retired[1:]
+
+		retired.track.released = true
+		if retired.track.rewind == 0 {
+			delete(s.tracks, retired.track.id.String())
+		}
+
+		for _, key := range retired.keys {
+			err := s.Store.Remove(key)
+			if err != nil && err != ErrDataNotFound {
+				log.Printf("Cannot remove data from store: %s (%s).\n", err.Error(), s.id.String())
+			}
+		}
+	}
+}
+
+// retiredTrack is a track removed from the playlists, whose data is released at expires.
+type retiredTrack struct {
+	track   *Track
+	keys    []string
+	expires time.Time
+}
+
+func partKey(track *Track, index int) string {
+	return fmt.Sprintf("%s-%d", track.id.String(), index)
+}
+
+func (s *Stream) notifyPublished() {
+	select {
+	case s.published <- struct{}{}:
+	default:
+	}
 }
 
 func (s *Stream) queueLoop() {
-	fetchFailed := make(chan struct{})
+	defer s.routines.Done()
+
+	// The head track, whose parts are removed as they are played.
+	var playing *Track
 
 	for {
+		var (
+			track *Track
+			part  *Part
+		)
+
 		s.RLock()
+		if len(s.queue) > 0 && len(s.queue[0].queue) > 0 {
+			track = s.queue[0]
+			part = track.queue[0]
+		}
+		fetching := s.fetching
+		s.RUnlock()
 
-		// TODO: Cancel/Wait for new parts rather than 'throwing'.
-		if len(s.queue) == 0 {
-			s.RUnlock()
-			s.globalError(ErrPlaylistEmpty)
-			return
+		if track != nil && track != playing {
+			playing = track
+
+			s.Lock()
+			track.started = time.Now()
+			s.Unlock()
+			s.emit(trackEvent(TrackStarted, track))
 		}
 
-		track := s.queue[0]
-		if len(track.queue) == 0 {
-			s.RUnlock()
-			s.globalError(ErrTrackNotClear)
+		// Wait for the next part to be played, or for the running fetch to publish one.
+		var (
+			played    <-chan time.Time
+			published <-chan struct{}
+		)
+		if part != nil {
+			s.Lock()
+			s.current = part
+			s.currentStart = time.Now()
+			index := len(track.parts) - len(track.queue)
+			s.Unlock()
+
+			event := trackEvent(PartStarted, track)
+			event.Index = index
+			event.Duration = part.seg.Duration
+			s.emit(event)
+
+			// TODO: Use time difference for removal.
+			played = time.After(time.Duration(part.seg.Duration * float64(time.Second)))
+		} else if fetching {
+			published = s.published
+		} else {
+			s.fail(ErrPlaylistEmpty)
 			return
 		}
 
-		part := track.queue[0]
-		s.RUnlock()
-
-		// TODO: Use time difference for removal.
-		// Wait for chunk to be played or stop message.
+		// Skips and pauses shift the queued parts.
+		skip := false
 		select {
-		case <-time.After(time.Duration(part.seg.Duration * float64(time.Second))):
+		case <-played:
+		case <-published:
+			continue
 		case <-s.pauseChan:
-			<-s.resumeChan
-		case <-fetchFailed:
+			select {
+			case <-s.resumeChan:
+			case <-s.ctx.Done():
+				return
+			}
+			if part == nil {
+				continue
+			}
+		case <-s.skipChan:
+			if part == nil {
+				continue
+			}
+			skip = true
+		case <-s.ctx.Done():
 			return
 		}
 
 		s.Lock()
-		err := s.playlist.Remove()
+		var err error
+		if skip {
+			err = s.skipTrack(track)
+		} else {
+			err = s.removePart(track)
+		}
+		if err == nil {
+			s.stamp()
+		}
+		s.releaseTracks(false)
+		s.Unlock()
+
 		if err != nil {
-			s.Unlock()
-			s.globalError(err)
+			s.fail(err)
 			return
 		}
 
-		// If track is empty, remove it from the map and queue.
-		if track.slide() {
-			s.queue = s.queue[1:]
-			delete(s.tracks, track.id.String())
+		if s.shouldFetchPlaylist() {
+			log.Printf("Playlist almost empty: %.2fs (%s).\n", s.available, s.id.String())
+			go s.watchFetch(s.startFetch(nil))
 		}
+	}
+}
 
-		// Remove segment duration from the total.
-		s.available -= part.seg.Duration
+// removePart removes the oldest part of the playlist, which is the next part of the head track.
+func (s *Stream) removePart(track *Track) error {
+	part := track.queue[0]
+	index := len(track.parts) - len(track.queue)
 
-		s.Unlock()
+	// Renditions playlists always contain the same parts.
+	for r, rendition := range s.renditions {
+		err := rendition.playlist.Remove()
+		if err != nil {
+			return err
+		}
 
-		if s.shouldFetchPlaylist() {
-			log.Printf("Playlist almost empty: %.2fs (%s).\n", s.available, s.id.String())
-			go func() {
-				err := s.queueNextPlaylist()
-				if err != nil {
-					s.globalError(err)
-					fetchFailed <- struct{}{}
-				}
-			}()
+		// Players match segments across reloads using the discontinuity sequence.
+		if part.renditions[r].Discontinuity {
+			rendition.playlist.DiscontinuitySeq++
 		}
 	}
+
+	// Skipped parts were never played.
+	if s.options.DVRWindow > 0 && !track.skipped {
+		s.keepPart(track, index, part)
+	}
+
+	// If track is empty and fully published, remove it from the map and queue.
+	if track.slide() && track.complete {
+		s.finishTrack(track)
+	}
+
+	// Remove segment duration from the total.
+	s.available -= part.seg.Duration
+
+	return nil
 }
 
-func (s *Stream) globalError(err error) {
-	s.state = killed
-	if s.errChan != nil {
-		s.errChan <- err
+// skipTrack removes all the remaining parts of the head track.
+func (s *Stream) skipTrack(track *Track) error {
+	track.skipped = true
+	for len(track.queue) > 0 {
+		err := s.removePart(track)
+		if err != nil {
+			return err
+		}
 	}
+
+	// Tracks start with a discontinuity, so players already reset their decoder on the next one.
+	return nil
 }
 
 func (s *Stream) WritePlaylist(writer io.Writer) (int, error) {
@@ -329,30 +980,33 @@ func (s *Stream) WritePlaylist(writer io.Writer) (int, error) {
 	return writer.Write(data)
 }
 
-func (s *Stream) getPart(trackId string, index int) (*Part, error) {
+func (s *Stream) openPart(trackId string, index int) (io.ReadCloser, error) {
 	s.RLock()
-	defer s.RUnlock()
-
-	// Because we never alter the part's data we don't need to make a copy before writing.
 	track, exists := s.tracks[trackId]
-	if !exists {
+	if !exists || index < 0 || index >= len(track.parts) {
+		s.RUnlock()
 		return nil, ErrPartNotFound
 	}
+	s.RUnlock()
 
-	if index < 0 || index >= len(track.parts) {
+	// The track may have been removed in the meantime.
+	r, err := s.openData(partKey(track, index))
+	if err == ErrDataNotFound {
 		return nil, ErrPartNotFound
 	}
 
-	return track.parts[index], nil
+	return r, err
 }
 
 func (s *Stream) WritePartData(writer io.Writer, trackId string, index int) (int, error) {
-	part, err := s.getPart(trackId, index)
+	r, err := s.openPart(trackId, index)
 	if err != nil {
 		return 0, err
 	}
+	defer r.Close()
 
-	return writer.Write(part.data)
+	n, err := io.Copy(writer, r)
+	return int(n), err
 }
 
 func (s *Stream) WriteInfo(writer io.Writer, trackId string) (int, error) {
@@ -384,18 +1038,41 @@ func (s *Stream) TrackInfo(trackId string) (*TrackInfo, error) {
 	return &track.info, nil
 }
 
-func (s *Stream) WriteTrack(writer io.Writer, trackId string) (int, error) {
+// TrackFile returns the format of the audio file written by WriteTrack.
+func (s *Stream) TrackFile(trackId string) (*TrackFile, error) {
 	s.RLock()
+	defer s.RUnlock()
 
-	// Because we never alter the track's data we don't need to make a copy before writing.
 	track, exists := s.tracks[trackId]
 	if !exists {
-		return 0, ErrTrackNotFound
+		return nil, ErrTrackNotFound
 	}
 
+	file := track.file()
+	return &file, nil
+}
+
+func (s *Stream) WriteTrack(writer io.Writer, trackId string) (int, error) {
+	s.RLock()
+	track, exists := s.tracks[trackId]
 	s.RUnlock()
 
-	return writer.Write(track.data)
+	if !exists {
+		return 0, ErrTrackNotFound
+	}
+
+	// Local tracks are only read from disk when downloaded.
+	r, err := s.Store.Open(trackId)
+	if err == ErrDataNotFound {
+		r, err = track.Open()
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(writer, r)
+	return int(n), err
 }
 
 func (s *Stream) TrackAvailable(trackId string) bool {
@@ -405,3 +1082,40 @@ func (s *Stream) TrackAvailable(trackId string) bool {
 	_, exists := s.tracks[trackId]
 	return exists
 }
+
+// Feedback gives a thumb up (positive) or down to a queued or played track.
+func (s *Stream) Feedback(trackId string, positive bool) error {
+	s.RLock()
+	track, exists := s.tracks[trackId]
+	s.RUnlock()
+
+	// Listeners mostly react once the track is over.
+	if !exists && s.History != nil {
+		var err error
+		track, err = s.History.feedbackTrack(trackId)
+		exists = err == nil
+	}
+	if !exists {
+		return ErrTrackNotFound
+	}
+
+	source, ok := s.source.(FeedbackSource)
+	if !ok {
+		return ErrFeedbackUnsupported
+	}
+
+	err := source.Feedback(s.station, track, positive)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	track.feedback = &positive
+	s.Unlock()
+
+	if s.History != nil {
+		s.History.setFeedback(trackId, positive)
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package musiko
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"github.com/scotow/musiko/pandoratest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeout = 10 * time.Second
+
+// newTestStream starts a stream of a station of the fake Pandora API, with parts of 2 sec.
+func newTestStream(t *testing.T, options StreamOptions, history *History) (*pandoratest.Server, *Stream) {
+	t.Helper()
+	server, client := newTestClient(t)
+
+	station, err := client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station: %s", err)
+	}
+
+	if options.SegmentTime == 0 {
+		options.SegmentTime = 2 * time.Second
+	}
+	stream, err := NewStream(client, station, options)
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	stream.URIModifier = func(id string, index int) string {
+		return fmt.Sprintf("%s/%d", id, index)
+	}
+	stream.History = history
+
+	err = stream.Start(context.Background())
+	if err != nil {
+		t.Fatalf("cannot start stream: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = stream.Stop()
+	})
+
+	return server, stream
+}
+
+// skip skips the head track, once the next one is queued.
+func skip(t *testing.T, stream *Stream) {
+	t.Helper()
+
+	// The stream starts with the first part of the first track, the next ones follow.
+	deadline := time.Now().Add(testTimeout)
+	err := stream.Skip()
+	for err == ErrNoNextTrack && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		err = stream.Skip()
+	}
+	if err != nil {
+		t.Fatalf("cannot skip: %s", err)
+	}
+}
+
+// waitEvent waits for an event of the given type.
+func waitEvent(t *testing.T, events <-chan Event, eventType EventType) Event {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("stream over while waiting for %s", eventType)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+		}
+	}
+}
+
+// waitQueued waits for the stream to queue count tracks.
+func waitQueued(t *testing.T, stream *Stream, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		stream.RLock()
+		queued := len(stream.queue)
+		stream.RUnlock()
+
+		if queued >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d tracks queued, expected %d", queued, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// playlistParts decodes a media playlist of the stream and returns its segments.
+func playlistParts(t *testing.T, stream *Stream) []*m3u8.MediaSegment {
+	t.Helper()
+
+	buffer := new(bytes.Buffer)
+	_, err := stream.WritePlaylist(buffer)
+	if err != nil {
+		t.Fatalf("cannot write playlist: %s", err)
+	}
+
+	playlist, listType, err := m3u8.DecodeFrom(buffer, true)
+	if err != nil || listType != m3u8.MEDIA {
+		t.Fatalf("invalid playlist: %v", err)
+	}
+
+	var segments []*m3u8.MediaSegment
+	for _, seg := range playlist.(*m3u8.MediaPlaylist).Segments {
+		if seg != nil {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
+
+func TestStreamPublishesParts(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{WindowSize: 4}, nil)
+
+	segments := playlistParts(t, stream)
+	if len(segments) != 4 {
+		t.Fatalf("got %d segments, expected a full window of 4", len(segments))
+	}
+
+	for _, seg := range segments {
+		if seg.Duration <= 0 || seg.Duration > 2.1 {
+			t.Errorf("segment %s lasts %f sec", seg.URI, seg.Duration)
+		}
+
+		fields := strings.Split(seg.URI, "/")
+		index, _ := strconv.Atoi(fields[1])
+
+		buffer := new(bytes.Buffer)
+		n, err := stream.WritePartData(buffer, fields[0], index)
+		if err != nil {
+			t.Fatalf("cannot serve part %s: %s", seg.URI, err)
+		}
+		if n == 0 || n%tsPacketSize != 0 {
+			t.Errorf("part %s is %d bytes, not a TS file", seg.URI, n)
+		}
+	}
+}
+
+func TestStreamSkip(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{WindowSize: 4}, nil)
+	events := stream.Subscribe()
+	defer stream.Unsubscribe(events)
+
+	head := strings.Split(playlistParts(t, stream)[0].URI, "/")[0]
+
+	skip(t, stream)
+
+	finished := waitEvent(t, events, TrackFinished)
+	if finished.TrackId != head {
+		t.Errorf("finished track %s, expected the skipped %s", finished.TrackId, head)
+	}
+	started := waitEvent(t, events, TrackStarted)
+	if started.TrackId == head {
+		t.Errorf("skipped track started again")
+	}
+
+	// Players may still load the parts of the playlists fetched before the skip.
+	_, err := stream.WritePartData(new(bytes.Buffer), head, 1)
+	if err != nil {
+		t.Errorf("skipped part not served during the grace period: %s", err)
+	}
+}
+
+func TestStreamStop(t *testing.T) {
+	t.Parallel()
+	_, stream := newTestStream(t, StreamOptions{}, nil)
+	head := strings.Split(playlistParts(t, stream)[0].URI, "/")[0]
+
+	err := stream.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop: %s", err)
+	}
+
+	select {
+	case <-stream.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("stream not done after stop")
+	}
+	if stream.Err() != ErrStreamStopped {
+		t.Errorf("got error %v, expected %v", stream.Err(), ErrStreamStopped)
+	}
+	if _, err := stream.WritePartData(new(bytes.Buffer), head, 0); err != ErrPartNotFound {
+		t.Errorf("part still served after stop: %v", err)
+	}
+}
+
+func TestStreamFeedbackAfterFinish(t *testing.T) {
+	t.Parallel()
+	history, _ := NewHistory(10, 0, "")
+	server, stream := newTestStream(t, StreamOptions{}, history)
+	events := stream.Subscribe()
+	defer stream.Unsubscribe(events)
+
+	head := strings.Split(playlistParts(t, stream)[0].URI, "/")[0]
+	skip(t, stream)
+	waitEvent(t, events, TrackFinished)
+
+	err := stream.Feedback(head, true)
+	if err != nil {
+		t.Fatalf("cannot give feedback to a played track: %s", err)
+	}
+
+	if feedbacks := server.Feedbacks(); len(feedbacks) != 1 || !feedbacks[0].Positive {
+		t.Errorf("got feedbacks %+v", feedbacks)
+	}
+	entry, err := history.Entry(head)
+	if err != nil || entry.Feedback == nil || !*entry.Feedback {
+		t.Errorf("feedback not recorded in the history: %v", err)
+	}
+}
+
+func TestStreamFeedbackAfterReload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "history.json")
+	history, _ := NewHistory(10, 0, path)
+	server, stream := newTestStream(t, StreamOptions{}, history)
+	events := stream.Subscribe()
+	defer stream.Unsubscribe(events)
+
+	head := strings.Split(playlistParts(t, stream)[0].URI, "/")[0]
+	skip(t, stream)
+	waitEvent(t, events, TrackFinished)
+
+	err := history.Save()
+	if err != nil {
+		t.Fatalf("cannot save history: %s", err)
+	}
+
+	// The token of the played track is loaded with the history, by a stream that never played it.
+	loaded, err := NewHistory(10, 0, path)
+	if err != nil {
+		t.Fatalf("cannot load history: %s", err)
+	}
+	reloaded, err := NewStream(stream.source, stream.station, StreamOptions{})
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	reloaded.History = loaded
+
+	err = reloaded.Feedback(head, false)
+	if err != nil {
+		t.Fatalf("cannot give feedback after reload: %s", err)
+	}
+	if feedbacks := server.Feedbacks(); len(feedbacks) != 1 || feedbacks[0].Positive {
+		t.Errorf("got feedbacks %+v", feedbacks)
+	}
+
+	// The token is not served with the history.
+	entry, err := loaded.Entry(head)
+	if err != nil {
+		t.Fatalf("entry not loaded: %s", err)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil || entry.token == "" || strings.Contains(string(data), `"token"`) {
+		t.Errorf("token served with the entry: %s", data)
+	}
+
+	// Entries saved without token cannot get feedback.
+	loaded.Lock()
+	loaded.entries[len(loaded.entries)-1].token = ""
+	loaded.Unlock()
+	err = reloaded.Feedback(head, true)
+	if err != ErrNoTrackToken {
+		t.Errorf("got error %v, expected %v", err, ErrNoTrackToken)
+	}
+}
+
+func TestStreamSplitAhead(t *testing.T) {
+	t.Parallel()
+	server, client := newTestClient(t)
+	// Downloads overlap if the tracks are all split at once.
+	server.DownloadDelay = 100 * time.Millisecond
+
+	station, err := client.GetOrCreateStation("G18")
+	if err != nil {
+		t.Fatalf("cannot create station: %s", err)
+	}
+	stream, err := NewStream(client, station, StreamOptions{SegmentTime: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("cannot create stream: %s", err)
+	}
+	err = stream.Start(context.Background())
+	if err != nil {
+		t.Fatalf("cannot start stream: %s", err)
+	}
+	defer stream.Stop()
+
+	waitQueued(t, stream, 2*server.PlaylistSize)
+
+	// Each track is downloaded in the 3 Pandora qualities.
+	if downloads := server.MaxDownloads(); downloads > 3*(1+splitAhead) {
+		t.Errorf("got %d audio files downloaded at once, expected at most %d", downloads, 3*(1+splitAhead))
+	}
+}
@@ -22,6 +22,7 @@ type AutoPauser struct {
 	last     time.Time
 
 	resetChan chan struct{}
+	stopChan  chan struct{}
 }
 
 func NewAutoPauser(instance PauseResumable, timeout, tick time.Duration) *AutoPauser {
@@ -30,6 +31,7 @@ func NewAutoPauser(instance PauseResumable, timeout, tick time.Duration) *AutoPa
 	nap.timeout = timeout
 	nap.tick = tick
 	nap.resetChan = make(chan struct{})
+	nap.stopChan = make(chan struct{})
 
 	return nap
 }
@@ -50,7 +52,11 @@ func (ap *AutoPauser) Start() error {
 				}
 
 				// Wait for resume.
-				<-ap.resetChan
+				select {
+				case <-ap.resetChan:
+				case <-ap.stopChan:
+					return nil
+				}
 
 				// Set last reset time, resume instance and restart the ticker.
 				ap.last = time.Now()
@@ -62,10 +68,21 @@ func (ap *AutoPauser) Start() error {
 			}
 		case <-ap.resetChan:
 			ap.last = time.Now()
+		case <-ap.stopChan:
+			ticker.Stop()
+			return nil
 		}
 	}
 }
 
 func (ap *AutoPauser) Reset() {
-	ap.resetChan <- struct{}{}
+	select {
+	case ap.resetChan <- struct{}{}:
+	case <-ap.stopChan:
+	}
+}
+
+// Stop ends Start, the instance is left as is.
+func (ap *AutoPauser) Stop() {
+	close(ap.stopChan)
 }
@@ -2,14 +2,19 @@ package musiko
 
 import (
 	"bytes"
+	"context"
 	"github.com/google/uuid"
 	"github.com/grafov/m3u8"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 var (
@@ -18,10 +23,25 @@ var (
 	ErrSplitMismatch     = errors.New("Playlist and parts mismatch")
 )
 
+// Content types of the audio files of the tracks, by extension.
+var trackContentTypes = map[string]string{
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+}
+
+// TrackFile describes the original audio file of a track, as downloaded.
+type TrackFile struct {
+	ContentType string `json:"contentType"`
+	Extension   string `json:"extension"` // Including the dot.
+}
+
 type TrackInfo struct {
 	Artist string `json:"artist"`
 	Album  string `json:"album"`
 	Name   string `json:"name"`
+	Cover  string `json:"cover,omitempty"` // URL of the album art.
 }
 
 func NewTrack(url string, info TrackInfo, httpClient *http.Client) *Track {
@@ -30,30 +50,99 @@ func NewTrack(url string, info TrackInfo, httpClient *http.Client) *Track {
 	t.url = url
 	t.info = info
 	t.httpClient = httpClient
+	t.codec = ffmpegCopy
+	t.native = true
+
+	return t
+}
+
+func NewLocalTrack(path string, info TrackInfo) *Track {
+	t := new(Track)
+	t.id = uuid.New()
+	t.path = path
+	t.info = info
+
+	// MPEG-TS cannot carry FLAC and Vorbis, so transcode them.
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac", ".ogg":
+		t.codec = ffmpegAAC
+	case ".m4a":
+		t.codec = ffmpegCopy
+		t.native = true
+	default:
+		t.codec = ffmpegCopy
+	}
 
 	return t
 }
 
 type Track struct {
-	id   uuid.UUID
-	url  string
-	info TrackInfo
+	id    uuid.UUID
+	url   string
+	path  string
+	token string
+	info  TrackInfo
+
+	codec       []string
+	native      bool
+	codecs      string
+	segmentTime time.Duration
+
+	trackGain *float64
+	loudness  *Loudness
+
+	// Other renditions of the track, split on the same boundaries.
+	quality    string
+	alternates []*Track
 
 	data       []byte
 	httpClient *http.Client
+	ctx        context.Context
 
 	playlist *m3u8.MediaPlaylist
 	parts    []*Part
 	queue    []*Part
+	complete bool
+
+	started  time.Time
+	skipped  bool
+	feedback *bool
+	archived bool // The data of the track is released by the history.
+	rewind   int  // Number of parts kept in the DVR window.
+	kept     int  // Number of parts moved to the DVR window, the first ones of the track.
+	released bool // The track was removed and its grace period is over.
+
+	dateRange *dateRange
+	dash      *dashConfig // Nil if the track cannot be streamed with DASH.
 }
 
-func (t *Track) Open() (io.Reader, error) {
-	resp, err := t.httpClient.Get(t.url)
+// file returns the format of the audio file of the track, Pandora serving M4A files.
+func (t *Track) file() TrackFile {
+	extension := ".m4a"
+	if t.path != "" {
+		extension = strings.ToLower(filepath.Ext(t.path))
+	}
+
+	return TrackFile{ContentType: trackContentTypes[extension], Extension: extension}
+}
+
+func (t *Track) Open() (io.ReadCloser, error) {
+	if t.path != "" {
+		return os.Open(t.path)
+	}
+
+	req, err := http.NewRequestWithContext(t.context(), http.MethodGet, t.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
 		return nil, ErrAPIStatusCode
 	}
 
@@ -69,6 +158,7 @@ func (t *Track) GetData() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -83,27 +173,196 @@ func (t *Track) ClearData() {
 	t.data = nil
 }
 
-// TODO: Use defer to remove parts on error.
 func (t *Track) GetParts() (*m3u8.MediaPlaylist, []*Part, error) {
 	if t.playlist != nil && t.parts != nil {
 		return t.playlist, t.parts, nil
 	}
 
-	data, err := t.GetData()
+	parts := make([]*Part, 0)
+	err := t.StreamParts(func(part *Part) {
+		parts = append(parts, part)
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
+	playlist, err := partsPlaylist(parts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.playlist = playlist
+	t.parts = parts
+	t.queue = parts
+
+	return playlist, parts, nil
+}
+
+// StreamParts splits the track and calls publish with every part as soon as it is ready.
+// AAC-in-MP4 files are split natively while being downloaded, ffmpeg is used for the other formats.
+func (t *Track) StreamParts(publish func(*Part)) error {
+	if !t.native {
+		_, parts, err := t.ffmpegParts()
+		if err != nil {
+			return err
+		}
+
+		for _, part := range parts {
+			publish(part)
+		}
+		return nil
+	}
+
+	r, err := t.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Keep a copy of the file for downloads.
+	buffer := new(bytes.Buffer)
+
+	published, err := t.streamNativeParts(io.TeeReader(r, buffer), func(track *aacTrack) *tsSegmenter {
+		return newTSSegmenter(track, t.targetDuration())
+	}, publish)
+	if err == nil {
+		t.data = buffer.Bytes()
+		return nil
+	}
+
+	// Parts cannot be taken back once published.
+	if published {
+		return err
+	}
+
+	// Read the rest of the file and use the buffered splitters.
+	_, err = io.Copy(buffer, r)
+	if err != nil {
+		return err
+	}
+	t.data = buffer.Bytes()
+
+	_, parts, err := NativeSplitTS(t.data, t.targetDuration())
+	if err != nil {
+		if !FfmpegInstalled() {
+			return err
+		}
+
+		log.Printf("Native split failed, falling back to ffmpeg: %s (%s).\n", err.Error(), t.id.String())
+		_, parts, err = t.ffmpegParts()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, part := range parts {
+		publish(part)
+	}
+	return nil
+}
+
+// StreamAlignedParts splits the track like StreamParts, but cuts the parts at the boundaries received from another rendition.
+// Tracks not split natively are re-encoded in AAC-in-MP4 with ffmpeg first, and the file is not kept.
+func (t *Track) StreamAlignedParts(boundaries <-chan float64, publish func(*Part)) error {
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	if t.native {
+		r, err = t.Open()
+	} else {
+		r, err = t.encodeMP4()
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = t.streamNativeParts(r, func(track *aacTrack) *tsSegmenter {
+		return newAlignedTSSegmenter(track, boundaries)
+	}, publish)
+	return err
+}
+
+// streamNativeParts demuxes the MP4 file progressively and publishes the parts made by the segmenter.
+func (t *Track) streamNativeParts(r io.Reader, newSegmenter func(*aacTrack) *tsSegmenter, publish func(*Part)) (bool, error) {
+	var (
+		segmenter *tsSegmenter
+		published bool
+	)
+	err := streamAAC(r, func(track *aacTrack) {
+		t.codecs = track.config.codecs()
+		segmenter = newSegmenter(track)
+	}, func(sample aacSample) {
+		if part := segmenter.add(sample); part != nil {
+			publish(part)
+			published = true
+		}
+	})
+	if err != nil {
+		return published, err
+	}
+
+	if part := segmenter.flush(); part != nil {
+		publish(part)
+	}
+
+	return true, nil
+}
+
+// encodeMP4 re-encodes the track in MP4 with its ffmpeg codec arguments.
+func (t *Track) encodeMP4() (io.ReadCloser, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if t.path != "" {
+		data, err = FfmpegEncodeMP4(t.context(), t.path, nil, t.codec)
+	} else {
+		data, err = t.GetData()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = FfmpegEncodeMP4(t.context(), "-", bytes.NewReader(data), t.codec)
+		t.ClearData()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (t *Track) ffmpegParts() (*m3u8.MediaPlaylist, []*Part, error) {
 	tmp, err := ioutil.TempDir("", "musiko")
 	if err != nil {
 		return nil, nil, err
 	}
+	defer os.RemoveAll(tmp)
+
+	var playlistPath string
+	if t.path != "" {
+		// Local files are seekable, let ffmpeg read them directly.
+		playlistPath, err = FfmpegSplitFileTS(t.context(), t.path, tmp, t.codec, t.targetDuration())
+	} else {
+		var data []byte
+		data, err = t.GetData()
+		if err != nil {
+			return nil, nil, err
+		}
 
-	playlistPath, err := FfmpegSplitTS(bytes.NewBuffer(data), tmp)
+		playlistPath, err = FfmpegTranscodeTS(t.context(), bytes.NewBuffer(data), tmp, t.codec, t.targetDuration())
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return ffmpegPlaylistParts(tmp, playlistPath)
+}
+
+// ffmpegPlaylistParts reads the parts listed in a playlist written by ffmpeg in dir.
+func ffmpegPlaylistParts(dir string, playlistPath string) (*m3u8.MediaPlaylist, []*Part, error) {
 	playlistFile, err := os.Open(playlistPath)
 	if err != nil {
 		return nil, nil, err
@@ -134,28 +393,42 @@ func (t *Track) GetParts() (*m3u8.MediaPlaylist, []*Part, error) {
 			break
 		}
 
-		partData, err := ioutil.ReadFile(path.Join(tmp, seg.URI))
+		partData, err := ioutil.ReadFile(path.Join(dir, seg.URI))
 		if err != nil {
 			return nil, nil, err
 		}
 
-		parts = append(parts, &Part{partData, seg})
+		parts = append(parts, &Part{data: partData, seg: seg})
 	}
 
 	if uint(len(parts)) != playlistMedia.Count() {
 		return nil, nil, ErrSplitMismatch
 	}
 
-	err = os.RemoveAll(tmp)
-	if err != nil {
-		return nil, nil, err
+	return playlistMedia, parts, nil
+}
+
+// setContext cancels the downloads and ffmpeg processes of the track and its alternate renditions with ctx.
+func (t *Track) setContext(ctx context.Context) {
+	t.ctx = ctx
+	for _, alternate := range t.alternates {
+		alternate.ctx = ctx
 	}
+}
 
-	t.playlist = playlistMedia
-	t.parts = parts
-	t.queue = parts
+func (t *Track) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
 
-	return playlistMedia, parts, nil
+// targetDuration returns the target duration of the parts of the track.
+func (t *Track) targetDuration() time.Duration {
+	if t.segmentTime == 0 {
+		return defaultSegmentTime
+	}
+	return t.segmentTime
 }
 
 func (t *Track) slide() bool {